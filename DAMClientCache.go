@@ -9,22 +9,23 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"mime"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
-	"net/url"
 
-	"github.com/Tkanos/gonfig" // config management support
-	"github.com/lib/pq"        // golang postgres db driver
+	"github.com/lib/pq" // golang postgres db driver
 )
 
 //-----------------------------------------------------------------------------------------------//-----------------------------------------------------------------------------------------------
@@ -32,58 +33,18 @@ import (
 //-----------------------------------------------------------------------------------------------//-----------------------------------------------------------------------------------------------
 
 var db *sql.DB                      // db connection
-var sessionConfig = configuration{} // runtime config
 var gBuild string
-var gConfigPath string
+var gConfigPath string // the configuration file in use
+var gConfigSets []string // -set overrides from the command line, reapplied on reload
 var gMirror string
 
-// holds the config, populated from config.json
-type configuration struct {
-	DBhost            string
-	DBusr             string
-	DBpw              string
-	DBPort            string
-	ListenPort        string
-	DBName            string
-	WorkingFolderPath string
-	ChangesetPath     string
-	MirrorCkmPath     string
-	CachingEnabled    string
-	DebugLogging      string
-	DocReviewTargetDir string
-}
-
 func printMessage(a ...interface{}) {
 
-	if strings.ToUpper(sessionConfig.DebugLogging) == "YES" {
+	if sessionConfig().DebugLogging {
 		fmt.Println(a...)
 	}
 
 }
-func findFilename(pattern string, dir string) string {
-	cmd := exec.Command("find", dir, "-name ", pattern)
-
-	var outbuf, errbuf bytes.Buffer
-	cmd.Stdout = &outbuf
-	cmd.Stderr = &errbuf
-	cmd.Run()
-
-	stdout := outbuf.String()
-	return stdout
-}
-
-func grepDir(pattern string, dir string) string {
-	cmd := exec.Command("grep", "-r", "--exclude-dir=downloads", pattern, dir)
-
-	var outbuf, errbuf bytes.Buffer
-	cmd.Stdout = &outbuf
-	cmd.Stderr = &errbuf
-	cmd.Run()
-
-	stdout := outbuf.String()
-	return stdout
-}
-
 func readLn(r *bufio.Reader) (string, error) {
 	var (
 		isPrefix = true
@@ -156,15 +117,17 @@ func logMessage(message, ticket, logtype string) error {
 	return err
 }
 
+func dbConnectionString() string {
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", sessionConfig().DBhost, sessionConfig().DBPort, sessionConfig().DBusr, sessionConfig().DBpw, sessionConfig().DBName)
+}
+
 // initializes the db [postgres] connection with params held in the config file.
 func initDb() {
 
 	var err error
 	var _ pq.NullTime
 
-	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", sessionConfig.DBhost, sessionConfig.DBPort, sessionConfig.DBusr, sessionConfig.DBpw, sessionConfig.DBName)
-
-	db, err = sql.Open("postgres", psqlInfo)
+	db, err = sql.Open("postgres", dbConnectionString())
 	if err != nil {
 		printMessage("[DCC] ERROR not connected to DB!")
 
@@ -181,23 +144,6 @@ func initDb() {
 
 }
 
-// wrapper around linux grep utility
-func grepFile(file string, pattern string) string {
-
-	cmd := exec.Command("grep", pattern, file)
-
-	var outbuf, errbuf bytes.Buffer
-	cmd.Stdout = &outbuf
-	cmd.Stderr = &errbuf
-
-	err := cmd.Run()
-	if err != nil {
-		logMessage("grepFile finished with error: "+err.Error(), "", "ERROR")
-	}
-	stdout := outbuf.String()
-	return stdout
-}
-
 func defaultRetryPolicy(ctx context.Context, resp *http.Response, err error) (bool, error) {
 	// do not retry on context.Canceled or context.DeadlineExceeded
 	if ctx.Err() != nil {
@@ -220,126 +166,89 @@ func defaultRetryPolicy(ctx context.Context, resp *http.Response, err error) (bo
 
 func main() {
 
-	configFilename := "config.json"
+	var configFile string
+	var configSets configList
+	var showVersion bool
+	flag.StringVar(&configFile, "config", defaultConfigFile(), "configuration file")
+	flag.Var(&configSets, "set", "override a configuration field, Field=value (may be repeated)")
+	flag.BoolVar(&showVersion, "v", false, "print the version")
+	flag.Usage = func() { cliHelp(nil) }
+	known, ignored := knownArgs(os.Args[1:])
+	flag.CommandLine.Parse(known)
+	if len(ignored) > 0 {
+		println("[DCC] WARNING ignoring unrecognised arguments: " + strings.Join(ignored, " "))
+	}
 
-	if len(os.Args) > 1 {
-		aSwitch := os.Args[1]
-		if strings.ToLower(aSwitch) == "-v" {
-			println("DAMClientCache v" + gBuild)
-			return
-		}
+	if showVersion {
+		println("DAMClientCache v" + gBuild)
+		return
 	}
 
-	printMessage("[DCC] " + gBuild)
-	exePath := os.Args[0]
-	gConfigPath, _ := filepath.Split(exePath)
+	command, args := "serve", []string{}
+	if flag.NArg() > 0 {
+		command, args = strings.ToLower(flag.Arg(0)), flag.Args()[1:]
+	}
+	theCommand := findCommand(command)
+	if theCommand == nil {
+		cliHelp(nil)
+		os.Exit(2)
+	}
+	if command == "help" {
+		cliHelp(args)
+		return
+	}
 
-	err := gonfig.GetConf(gConfigPath+configFilename, &sessionConfig)
+	loaded, err := loadConfig(configFile, configSets)
 	if err != nil {
-		printMessage("[DCC] ERROR getting config: " + err.Error())
-		panic(err)
+		println("[DCC] ERROR getting config: " + err.Error())
+		os.Exit(1)
 	}
-	initDb()
-	defer db.Close()
-
-	if len(os.Args) > 1 {
-		aSwitch := os.Args[1]
-		if strings.ToLower(aSwitch) == "bulkmap" {
+	gConfig.Store(&loaded)
+	gConfigPath, gConfigSets = configFile, configSets
+	printMessage("[DCC] " + gBuild)
 
-			return
+	// the server won't start on a bad configuration; check-config reports it
+	if command == "serve" {
+		if problems := configProblems(*sessionConfig()); len(problems) > 0 {
+			for _, problem := range problems {
+				println("[DCC] ERROR config: " + problem)
+			}
+			os.Exit(1)
 		}
 	}
 
-	http.HandleFunc("/", handler)
-	initDb()
-	defer db.Close()
-
-	log.Println("Listening... (" + sessionConfig.ListenPort + ")")
+	if theCommand.needsDB {
+		initDb()
+		defer db.Close()
+		initSchema()
+	}
 
-	err = http.ListenAndServe(":"+sessionConfig.ListenPort, nil)
-	if err != nil {
-		fmt.Println("ERROR " + err.Error())
+	if err := theCommand.run(args); err != nil {
+		fmt.Println("[DCC] ERROR " + command + " : " + err.Error())
+		if db != nil {
+			db.Close()
+		}
+		os.Exit(1)
 	}
 }
 func nowAsUnixMilli() int64 {
 	return time.Now().UnixNano() / 1e6
 }
-func createArchive(ticketdir string) string {
-	// List of Files to Zip
-	var files []string
-
-	root := sessionConfig.ChangesetPath + "/" + ticketdir
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 
-		if strings.Contains(path, "downloads") {
-			return filepath.SkipDir
-		}
 
-		if !info.IsDir() {
-			files = append(files, path)
-		}
+func linkTicketHandler(w http.ResponseWriter, r *http.Request) {
 
-		return nil
-	})
+	theFolder, err := linkTicket(r.FormValue("theTicket"), r.FormValue("theDescription"), r.FormValue("theLead"), r.FormValue("theAssignee"))
 	if err != nil {
-		panic(err)
-	}
-
-	uid := nowAsUnixMilli()
-	output := fmt.Sprintf("%s/%s/downloads/%d-precache.zip", sessionConfig.ChangesetPath, ticketdir, uid)
-
-	if err := zipFiles(output, files); err != nil {
-		logMessage("zipFiles(): "+err.Error(), ticketdir, "ERROR")
-	}
-	fmt.Println("Zipped File:", output)
-	return output
-}
-
-
-func reviewDocumentHander(w http.ResponseWriter, r *http.Request) { 
-	
-
-	params := strings.Split(r.RequestURI, ",")
-
-	if len(params) < 1 {
+		http.Error(w, "linkTicketHandler() "+err.Error(), http.StatusNotModified)
 		return
 	}
-	ticket := params[1]
-	docname, err := url.QueryUnescape(params[2])
-
-	if err != nil {
-		logMessage("[DCC] reviewDocumentHander(): problems decoding document name param - " + err.Error(), ticket, "ERROR")
-	}
-	
-
-	filename := fmt.Sprintf("%s/%s", sessionConfig.DocReviewTargetDir, docname)
-	logMessage("[DCC] reviewDocumentHander(): Trying to create "+filename, ticket, "INFO")
-
-	file, err := os.Create(filename)
-
-	if err != nil {
-		logMessage(err.Error(), ticket, "ERROR")
-	}
-
-	n, err := io.Copy(file, r.Body)
-
-	if err != nil {
-		logMessage("[DCC] reviewDocumentHander(): "+err.Error(), ticket, "ERROR")
-	}
-
-	w.Write([]byte(fmt.Sprintf("%d bytes are recieved.\n", n)))
-
-	// if err != nil {
-	// 	logMessage(err.Error(), ticket, "ERROR")
-	// }
+	w.Write([]byte( theFolder) );
 }
 
-func linkTicketHandler(w http.ResponseWriter, r *http.Request) {
-
-	theTicket := r.FormValue("theTicket")
-	theDescription  := r.FormValue("theDescription")
-	theLead := r.FormValue("theLead")
-	theAssignee := r.FormValue("theAssignee")
+// linkTicket gives a ticket the first free folder and creates its change row,
+// returning the folder.
+func linkTicket(theTicket, theDescription, theLead, theAssignee string) (string, error) {
 
 	theFolder := ""
 
@@ -348,10 +257,10 @@ func linkTicketHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		if err, ok := err.(*pq.Error); ok {
 			printMessage("[DCC] pq ERROR:", err.Code.Name())
-			logMessage("linkTicketHandler() couldn't SELECT from damfolder :"+err.Code.Name(), "", "ERROR")
-			http.Error(w, "linkTicketHandler() couldn't SELECT from damfolder :"+err.Code.Name(), http.StatusNotModified)			
+			logMessage("linkTicket() couldn't SELECT from damfolder :"+err.Code.Name(), "", "ERROR")
+			return "", fmt.Errorf("couldn't SELECT from damfolder :%s", err.Code.Name())
 		}
-		return 
+		return "", err
 	}
 	defer rows.Close()
 	for rows.Next() {
@@ -360,6 +269,10 @@ func linkTicketHandler(w http.ResponseWriter, r *http.Request) {
 		)
 		break
 	}
+	if theFolder == "" {
+		logMessage("linkTicket() no free folder for "+theTicket, "", "ERROR")
+		return "", fmt.Errorf("no free folder for %s", theTicket)
+	}
 
 	sqlStatement := `
 		update damfolder set jirakey = $1 where folder = $2`
@@ -367,9 +280,8 @@ func linkTicketHandler(w http.ResponseWriter, r *http.Request) {
 	_, err = db.Exec(sqlStatement, theTicket, theFolder)
 	if err, ok := err.(*pq.Error); ok {
 		printMessage("[DCC] pq ERROR:", err.Code.Name())
-		logMessage("linkTicketHandler() couldn't UPDATE damfolder :"+err.Code.Name(), theFolder, "ERROR")
-		http.Error(w, "linkTicketHandler() couldn't UPDATE damfolder :"+err.Code.Name(), http.StatusNotModified)
-		return
+		logMessage("linkTicket() couldn't UPDATE damfolder :"+err.Code.Name(), theFolder, "ERROR")
+		return "", fmt.Errorf("couldn't UPDATE damfolder :%s", err.Code.Name())
 	}
 	
 	sqlStatement = `
@@ -380,12 +292,12 @@ func linkTicketHandler(w http.ResponseWriter, r *http.Request) {
 	_, err = db.Exec(sqlStatement, theTicket, theFolder, theDescription, theLead, theAssignee);
 	if err, ok := err.(*pq.Error); ok {
 		printMessage("[DCC] pq ERROR:", err.Code.Name())
-		logMessage("linkTicketHandler() couldn't UPDATE change :"+err.Code.Name(), theFolder, "ERROR")
-		http.Error(w, "linkTicketHandler() couldn't UPDATE change :"+err.Code.Name(), http.StatusNotModified)
-		return
+		logMessage("linkTicket() couldn't UPDATE change :"+err.Code.Name(), theFolder, "ERROR")
+		return "", fmt.Errorf("couldn't UPDATE change :%s", err.Code.Name())
 	}
-	logMessage("linkTicketHandler() : returning folder : " + theFolder, "", "INFO")
-	w.Write([]byte( theFolder) );
+	logMessage("linkTicket() : returning folder : " + theFolder, "", "INFO")
+	go checkChangeStates()
+	return theFolder, nil
 }
 
 func readyHandler(w http.ResponseWriter, r *http.Request) {
@@ -399,6 +311,24 @@ func readyHandler(w http.ResponseWriter, r *http.Request) {
 		bReady = false
 	}
 
+	if bReady {
+		outstanding, err := outstandingReviews(theFolder)
+		if err != nil {
+			http.Error(w, "readyHandler() couldn't check outstanding reviews", http.StatusInternalServerError)
+			return
+		}
+		if len(outstanding) > 0 {
+			logMessage(fmt.Sprintf("readyHandler() %d required reviews still outstanding", len(outstanding)), theFolder, "INFO")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(struct {
+				Error       string           `json:"error"`
+				Outstanding []reviewDocument `json:"outstanding"`
+			}{"required reviews are outstanding", outstanding})
+			return
+		}
+	}
+
 	sqlStatement := `
 		update "change" ch 
 		set state_ready = $1 
@@ -414,52 +344,73 @@ func readyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	go checkChangeStates()
 }
 
 
 
+// wipRemoveHandler moves a WIP asset's file into the ticket's trash and deletes its
+// damasset row; wipUndoRemoveHandler brings both back.
 func wipRemoveHandler(w http.ResponseWriter, r *http.Request) {
 	theFolder := r.FormValue("theFolder")
 	theTemplateID := r.FormValue("theTemplateID")
-	fullfilepath := ""
 
-	//theFilePath := theFolder + "\\" + theTemplateName
-	//theHash := ""
-
-	sql := `select fullfilepath from damasset WHERE folder = $1 AND resourcemainid = $2`
-	rows, err := db.Query(sql, theFolder, theTemplateID )
+	asset, err := trashAsset(theFolder, theTemplateID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "wipRemoveHandler() no damasset row for "+theTemplateID, http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		if err, ok := err.(*pq.Error); ok {
-			printMessage("wipRemoveHandler() ERROR:", err.Code.Name())
-			logMessage("wipRemoveHandler() couldn't SELECT from damasset :"+err.Code.Name(), "", "ERROR")
+			printMessage("[DCC] pq ERROR:", err.Code.Name())
 		}
-		return 
-	}
-	
-	defer rows.Close()
-		for rows.Next() {
-			err = rows.Scan(
-			&fullfilepath,
-		)
+		logMessage("wipRemoveHandler() couldn't remove "+theTemplateID+" : "+err.Error(), theFolder, "ERROR")
+		status := http.StatusInternalServerError
+		if err == errOutsideTicket {
+			status = http.StatusForbidden
+		}
+		http.Error(w, "wipRemoveHandler() couldn't remove "+theTemplateID+" : "+err.Error(), status)
+		return
 	}
 
-	fullfilepath = strings.ReplaceAll(fullfilepath, "\\", "/")
+	logMessage("wipRemoveHandler() moved "+asset.Fullfilepath+" to trash "+asset.TrashID, theFolder, "DEBUG")
+	asset.Fullfilepath = clientAssetPath(asset.Fullfilepath)
+	writeJSON(w, asset)
+}
 
-	logMessage( "wipRemoveHandler trying to remove " + fullfilepath, theFolder, "DEBUG" )
-	os.Remove( fullfilepath )
-	
+func wipUndoRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	theFolder := r.FormValue("theFolder")
+	theTemplateID := r.FormValue("theTemplateID")
+	theTrashID := r.FormValue("theTrashID")
 
-	sqlStatement := `
-		DELETE FROM public.damasset WHERE folder = $1 AND resourcemainid = $2`
+	var err error
+	if theTrashID == "" {
+		theTrashID, err = latestTrashID(theFolder, theTemplateID)
+		if err != nil {
+			http.Error(w, "wipUndoRemoveHandler() nothing to restore for "+theTemplateID, http.StatusNotFound)
+			return
+		}
+	}
 
-	_, err = db.Exec(sqlStatement, theFolder, theTemplateID)
-	if err, ok := err.(*pq.Error); ok {
-		printMessage("[DCC] pq ERROR:", err.Code.Name())
-		logMessage("wipRemoveHandler() couldn't DELETE from damasset :"+err.Code.Name(), theFolder, "ERROR")
-		http.Error(w, "wipRemoveHandler() couldn't DELETE from damasset :"+err.Code.Name(), http.StatusNotModified)
+	asset, err := restoreAsset(theFolder, theTrashID)
+	if err != nil {
+		logMessage("wipUndoRemoveHandler() couldn't restore "+theTrashID+" : "+err.Error(), theFolder, "ERROR")
+		status := http.StatusInternalServerError
+		switch {
+		case os.IsNotExist(err):
+			status = http.StatusNotFound
+		case os.IsExist(err):
+			status = http.StatusConflict
+		case err == errOutsideTicket:
+			status = http.StatusForbidden
+		}
+		http.Error(w, "wipUndoRemoveHandler() couldn't restore "+theTrashID+" : "+err.Error(), status)
 		return
 	}
 
+	logMessage("wipUndoRemoveHandler() restored "+asset.Fullfilepath, theFolder, "DEBUG")
+	asset.Fullfilepath = clientAssetPath(asset.Fullfilepath)
+	writeJSON(w, asset)
 }
 
 func wipHandler(w http.ResponseWriter, r *http.Request) {
@@ -468,16 +419,45 @@ func wipHandler(w http.ResponseWriter, r *http.Request) {
 	theFolder := r.FormValue("theFolder")
 	theTemplateID := r.FormValue("theTemplateID")
 	theTemplateName := r.FormValue("theTemplateName")
-	theFilePath := sessionConfig.ChangesetPath + "\\" + theFolder + "\\" + theTemplateName
+	theFilePath, err := canonicalAssetPath(theFolder, theTemplateName)
+	if err != nil {
+		http.Error(w, "WIPHandler() bad template name : "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// an asset already in damasset keeps the base it was first recorded with;
+	// moving it on to the current mirror copy would hide the mirror's changes since
+	result, err := db.Exec(`
+		update damasset set updated = $3
+		where folder = $1 and resourcemainid = $2`, theFolder, theTemplateID, time.Now())
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			printMessage("[DCC] pq ERROR:", err.Code.Name())
+		}
+		logMessage("WIPHandler() couldn't UPDATE damasset :"+err.Error(), theFolder, "ERROR")
+		http.Error(w, "WIPHandler() couldn't UPDATE damasset", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		return
+	}
 
-	theHash := ""
+	// the mirror version it starts from, for merging later mirror changes
+	theHash, theVersion, err := recordMirrorBase(theFolder, theTemplateID)
+	if err == errIndexNotLoaded {
+		http.Error(w, "WIPHandler() "+err.Error()+", try again shortly", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		logMessage("WIPHandler() couldn't record mirror base : "+err.Error(), theFolder, "ERROR")
+	}
 
 	sqlStatement := `
 		INSERT INTO public.damasset
 		(      fullfilepath, filename, resourcemainid, initialmd5, initialversion, modified, islatest,  created, updated, importanttouser, folder)
-		VALUES(   $2,            $3,              $4,            $5,         0,        $8,     true,      $6,      $7,      $9,              $1);	`
+		VALUES(   $2,            $3,              $4,            $5,         $10,      $8,     true,      $6,      $7,      $9,              $1);	`
 
-	_, err := db.Exec(sqlStatement, theFolder, theFilePath, theTemplateName, theTemplateID, theHash, time.Now(), time.Now(), false, 1)
+	_, err = db.Exec(sqlStatement, theFolder, theFilePath, theTemplateName, theTemplateID, theHash, time.Now(), time.Now(), false, 1, theVersion)
 	if err, ok := err.(*pq.Error); ok {
 		printMessage("[DCC] pq ERROR:", err.Code.Name())
 		logMessage("WIPHandler() couldn't INSERT into damasset :"+err.Code.Name(), theFolder, "ERROR")
@@ -491,26 +471,42 @@ func removeTicket(w http.ResponseWriter, r *http.Request) {
 
 	params := strings.Split(r.RequestURI, ",")
 
-	if len(params) < 1 {
+	if len(params) < 3 {
 		return
 	}
 
-	var sTemplateID =  params[1]
+	var sTicket =  params[1]
 	var sFolder = params[2]
-	
+
+	if err := closeTicket(sTicket, sFolder); err != nil {
+		http.Error(w, "removeTicket() "+err.Error(), http.StatusNotModified)
+	}
+}
+
+// closeTicket closes the ticket in the DAM and empties its folder for reuse.
+func closeTicket(sTicket, sFolder string) error {
+
+	theFilePath, err := ticketDir(sFolder)
+	if err != nil {
+		return err
+	}
+
 	sql := `select null from closeticket($1)`
-	rows, err := db.Query(sql, sTemplateID)
+	rows, err := db.Query(sql, sTicket)
 	if err != nil {
 		if err, ok := err.(*pq.Error); ok {
 			printMessage("[DCC] pq ERROR:", err.Code.Name())
-			logMessage("removeTicket() couldn't SELECT from closeticket :"+err.Code.Name(), "", "ERROR")
-			http.Error(w, "removeTicket() couldn't SELECT from closeticket :"+err.Code.Name(), http.StatusNotModified)			
+			logMessage("closeTicket() couldn't SELECT from closeticket :"+err.Code.Name(), "", "ERROR")
+			return fmt.Errorf("couldn't SELECT from closeticket :%s", err.Code.Name())
 		}
-		return
+		return err
 	}
 	defer rows.Close()
-	
-	theFilePath := sessionConfig.ChangesetPath + "/" + sFolder
+
+	// nothing in a closed ticket can be restored
+	if err := purgeTrash(sFolder, time.Now()); err != nil {
+		logMessage("closeTicket() couldn't purge trash :"+err.Error(), sFolder, "ERROR")
+	}
 
 	err = filepath.Walk(theFilePath,
 		func(path string, info os.FileInfo, err error) error {
@@ -525,14 +521,14 @@ func removeTicket(w http.ResponseWriter, r *http.Request) {
 			return nil			
 	})
 
+	go checkChangeStates()
+
 	if err != nil {
 		printMessage("[DCC] Problems deleting files from folder :", err.Error())
-		logMessage("removeTicket() Problems deleting files from folder :"+ err.Error(), "", "ERROR")
-		http.Error(w, "removeTicket() Problems deleting files from folder :" + err.Error(), http.StatusNotModified)			
-}
-
-
-
+		logMessage("closeTicket() Problems deleting files from folder :"+ err.Error(), "", "ERROR")
+		return fmt.Errorf("problems deleting files from folder :%s", err.Error())
+	}
+	return nil
 }
 
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
@@ -548,7 +544,7 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	ticket := params[1]
 	uid := nowAsUnixMilli()
 	//filename := fmt.Sprintf( "./%s-%d.zip", ticket, uid)
-	filename := fmt.Sprintf("%s/%s/downloads/%d-postcache.zip", sessionConfig.ChangesetPath, ticket, uid)
+	filename := fmt.Sprintf("%s/%s/downloads/%d-postcache.zip", sessionConfig().ChangesetPath, ticket, uid)
 	file, err := os.Create(filename)
 
 	if err != nil {
@@ -561,9 +557,9 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Write([]byte(fmt.Sprintf("%d bytes are recieved.\n", n)))
 
-	//_, err = Unzip( filename, sessionConfig.ChangesetPath + "/" + ticket + "/")
+	//_, err = Unzip( filename, sessionConfig().ChangesetPath + "/" + ticket + "/")
 
-	stdout, stderr := unzipWrapper(filename, sessionConfig.ChangesetPath+"/"+ticket+"/")
+	stdout, stderr := unzipWrapper(filename, sessionConfig().ChangesetPath+"/"+ticket+"/")
 
 	println("stdout " + stdout)
 	println("stderr " + stderr)
@@ -572,30 +568,20 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		logMessage(err.Error(), ticket, "ERROR")
 	}
 
+	gEvents.publish(eventUploadComplete, ticket, struct {
+		Bytes int64  `json:"bytes"`
+		File  string `json:"file"`
+	}{n, filepath.Base(filename)})
 }
 
 func getTemplateID(filepath string) string {
 
-	templateID := ""
-	file, err := os.Open(filepath)
+	header, err := readTemplateHeader(filepath)
 	if err != nil {
-		logMessage("getTemplateID os.Open() failed : "+err.Error(), "", "ERROR")
-		return templateID
+		logMessage("getTemplateID readTemplateHeader() failed : "+err.Error(), "", "ERROR")
 	}
 
-	lines, err := readFile(file)
-	if err != nil {
-		logMessage("getTemplateID readFile() failed : "+err.Error(), "", "ERROR")
-		return templateID
-	}
-	content := strings.Join(lines, " ")
-	splits := strings.Split(strings.ToLower(content), "<id>")
-	if len(splits) > 1 {
-		templateID = (splits[1])[0:36] // TODO: HACK: assumes id format is fixed....
-	}
-	defer file.Close()
-
-	return templateID
+	return header.TemplateID
 
 }
 
@@ -622,22 +608,24 @@ func handler(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case "GET":
-		if strings.Contains(r.URL.Path, "isCachingEnabled") {
 
-			w.Write([]byte(sessionConfig.CachingEnabled))
+		if strings.Contains(r.URL.Path, "/events") {
+			eventsHandler(w, r)
 			return
 		}
 
-		if strings.Contains(r.URL.Path, "createArchive") {
-			params := strings.Split(r.RequestURI, ",")
-
-			if len(params) < 1 {
-				return
-			}
+		if strings.Contains(r.URL.Path, "isCachingEnabled") {
+			isCachingEnabledHandler(w, r)
+			return
+		}
 
-			ticket := params[1]
-			buildAndSendArchive(w, r, ticket)
+		if strings.Contains(r.URL.Path, "createArchive") {
+			buildAndSendArchive(w, r)
+		}
 
+		if strings.Contains(r.URL.Path, "transform_support_version") {
+			querySupportVersion(w)
+			return
 		}
 
 		if strings.Contains(r.URL.Path, "transform_support") {
@@ -666,6 +654,70 @@ func handler(w http.ResponseWriter, r *http.Request) {
 			queryTemplateByID(w, sTemplateID)
 		}
 
+		if strings.Contains(r.URL.Path, "mirrortemplate") {
+			mirrorTemplateHandler(w, r)
+		}
+
+		if strings.Contains(r.URL.Path, "mirrorcontent") {
+			mirrorContentHandler(w, r)
+		}
+
+		if strings.Contains(r.URL.Path, "mirrorhistory") {
+			mirrorHistoryHandler(w, r)
+		}
+
+		if strings.Contains(r.URL.Path, "mirrorupdates") {
+			mirrorUpdatesHandler(w, r)
+		}
+
+		if strings.Contains(r.URL.Path, "whereused") {
+			whereUsedHandler(w, r)
+		}
+
+		if strings.Contains(r.URL.Path, "overlap") {
+			overlapHandler(w, r)
+		}
+
+		if strings.Contains(r.URL.Path, "importantAssets") {
+			importantAssetsHandler(w, r)
+		}
+
+		if strings.Contains(r.URL.Path, "reviewdoclist") {
+			reviewDocListHandler(w, r)
+		}
+
+		if strings.Contains(r.URL.Path, "reviewdocstatus") {
+			reviewDocStatusHandler(w, r)
+		}
+
+		if strings.Contains(r.URL.Path, "reviewdocdownload") {
+			reviewDocDownloadHandler(w, r)
+		}
+
+		if strings.Contains(r.URL.Path, "reviewdecisions") {
+			reviewDecisionsHandler(w, r)
+		}
+
+		if strings.Contains(r.URL.Path, "reviewpack") {
+			reviewPackHandler(w, r)
+		}
+
+		if strings.Contains(r.URL.Path, "templatediff") {
+			templateDiffHandler(w, r)
+		}
+
+		if strings.Contains(r.URL.Path, "mirrorchanges") {
+			mirrorChangesHandler(w, r)
+		}
+
+		if strings.Contains(r.URL.Path, "mergepreview") {
+			mergePreviewHandler(w, r)
+		}
+
+		if strings.Contains(r.URL.Path, "assetactivity") {
+			assetActivityHandler(w, r)
+		}
+
 
 		if strings.Contains(r.URL.Path, "change_status") {
 			params := strings.Split(r.RequestURI, ",")
@@ -692,10 +744,22 @@ func handler(w http.ResponseWriter, r *http.Request) {
 			wipRemoveHandler(w, r)
 		}
 
+		if strings.Contains(r.URL.Path, "/UndoRemoveWIP") {
+			wipUndoRemoveHandler(w, r)
+		}
+
 		if strings.Contains(r.URL.Path, "/WIP") {
 			wipHandler(w, r)
 		}
 
+		if strings.Contains(r.URL.Path, "/flagImportant") {
+			flagImportantHandler(w, r)
+		}
+
+		if strings.Contains(r.URL.Path, "/unflagImportant") {
+			unflagImportantHandler(w, r)
+		}
+
 		if strings.Contains(r.URL.Path, "/ready") {
 			readyHandler(w, r)
 		}
@@ -708,6 +772,26 @@ func handler(w http.ResponseWriter, r *http.Request) {
 			reviewDocumentHander(w, r)
 		}
 
+		if strings.Contains(r.URL.Path, "/reviewDecision") {
+			reviewDecisionHandler(w, r)
+		}
+
+		if strings.Contains(r.URL.Path, "/generateReview") {
+			generateReviewHandler(w, r)
+		}
+
+		if strings.Contains(r.URL.Path, "/cachingPolicy") {
+			cachingPolicyHandler(w, r)
+		}
+
+		if strings.Contains(r.URL.Path, "/applyMerge") {
+			applyMergeHandler(w, r)
+		}
+
+		if strings.Contains(r.URL.Path, "/selectiveArchive") {
+			selectiveArchiveHandler(w, r)
+		}
+
 
 		
 
@@ -773,78 +857,46 @@ func queryTemplateByID(w http.ResponseWriter, sTemplateID string) {
 
 func buildAndSendSupport(w http.ResponseWriter, r *http.Request) {
 
-	Filename := "/opt/ckm-mirror/transform-support.zip"
-
-	//Check if file exists and open
-	Openfile, err := os.Open(Filename)
-	defer Openfile.Close() //Close after function return
+	version, err := refreshSupportBundle()
 	if err != nil {
-		//File not found, send 404
-		http.Error(w, "File not found.", 404)
-		return
+		logMessage("buildAndSendSupport() couldn't refresh support bundle : "+err.Error(), "", "ERROR")
 	}
 
-	//File is found, create and send the correct headers
-
-	//Get the Content-Type of the file
-	//Create a buffer to store the header of the file in
-	FileHeader := make([]byte, 512)
-	//Copy the headers into the FileHeader buffer
-	Openfile.Read(FileHeader)
-	//Get content type of file
-	FileContentType := http.DetectContentType(FileHeader)
-
-	//Get the file size
-	FileStat, _ := Openfile.Stat()                     //Get info from file
-	FileSize := strconv.FormatInt(FileStat.Size(), 10) //Get file size as a string
-
-	//Send the headers
-	w.Header().Set("Content-Disposition", "attachment; filename="+Filename)
-	w.Header().Set("Content-Type", FileContentType)
-	w.Header().Set("Content-Length", FileSize)
-
-	//Send the file
-	//We read 512 bytes from the file already, so we reset the offset back to 0
-	Openfile.Seek(0, 0)
-	io.Copy(w, Openfile) //'Copy' the file to the client
+	if version != "" {
+		w.Header().Set("ETag", `"`+version+`"`)
+		w.Header().Set("X-Support-Version", version)
+	}
 
+	sendFile(w, r, supportBundlePath())
 }
 
-func buildAndSendArchive(w http.ResponseWriter, r *http.Request, ticket string) {
-	Filename := createArchive(ticket)
+// sendFile streams a file to the client as an attachment named after its base name.
+// http.ServeContent takes care of Range requests (so interrupted downloads can resume)
+// and of If-Modified-Since / If-None-Match against any ETag already set on w.
+func sendFile(w http.ResponseWriter, r *http.Request, filename string) {
 
-	//Check if file exists and open
-	Openfile, err := os.Open(Filename)
-	defer Openfile.Close() //Close after function return
+	file, err := os.Open(filename)
 	if err != nil {
-		//File not found, send 404
-		http.Error(w, "File not found.", 404)
+		http.Error(w, "File not found.", http.StatusNotFound)
 		return
 	}
+	defer file.Close()
 
-	//File is found, create and send the correct headers
-
-	//Get the Content-Type of the file
-	//Create a buffer to store the header of the file in
-	FileHeader := make([]byte, 512)
-	//Copy the headers into the FileHeader buffer
-	Openfile.Read(FileHeader)
-	//Get content type of file
-	FileContentType := http.DetectContentType(FileHeader)
-
-	//Get the file size
-	FileStat, _ := Openfile.Stat()                     //Get info from file
-	FileSize := strconv.FormatInt(FileStat.Size(), 10) //Get file size as a string
+	info, err := file.Stat()
+	if err != nil {
+		logMessage("sendFile() couldn't stat "+filename+" : "+err.Error(), "", "ERROR")
+		http.Error(w, "File not available.", http.StatusInternalServerError)
+		return
+	}
+	if info.IsDir() {
+		http.Error(w, "File not found.", http.StatusNotFound)
+		return
+	}
 
-	//Send the headers
-	w.Header().Set("Content-Disposition", "attachment; filename="+Filename)
-	w.Header().Set("Content-Type", FileContentType)
-	w.Header().Set("Content-Length", FileSize)
+	name := filepath.Base(filename)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
 
-	//Send the file
-	//We read 512 bytes from the file already, so we reset the offset back to 0
-	Openfile.Seek(0, 0)
-	io.Copy(w, Openfile) //'Copy' the file to the client
+	http.ServeContent(w, r, name, info.ModTime(), file)
 }
 
 // Unzip will decompress a zip archive, moving all files and folders
@@ -908,48 +960,69 @@ func Unzip(src string, dest string) ([]string, error) {
 // ZipFiles compresses one or many files into a single zip archive file.
 // Param 1: filename is the output zip file's name.
 // Param 2: files is a list of files to add to the zip.
-func zipFiles(filename string, files []string) error {
+// Param 3: manifest describes the archive; its entries are filled in here and it is
+// added last as manifest.json.
+func zipFiles(filename string, files []string, manifest archiveManifest) error {
 
 	newZipFile, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
-	defer newZipFile.Close()
 
 	zipWriter := zip.NewWriter(newZipFile)
-	defer zipWriter.Close()
 
 	// Add files to zip
+	manifest.Entries = []manifestEntry{}
 	for _, file := range files {
-		if err = addFileToZip(zipWriter, file); err != nil {
-			return err
+		var entry manifestEntry
+		if entry, err = addFileToZip(zipWriter, sessionConfig().ChangesetPath, file); err != nil {
+			break
 		}
+		if isTemplateFile(file) {
+			entry.TemplateID = getTemplateID(file)
+		}
+		manifest.Entries = append(manifest.Entries, entry)
 	}
-	return nil
+	if err == nil {
+		err = addManifestToZip(zipWriter, manifest)
+	}
+
+	// closing writes the central directory, without which the zip is unreadable
+	if closeErr := zipWriter.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := newZipFile.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
-func addFileToZip(zipWriter *zip.Writer, filename string) error {
+// addFileToZip stores filename in the archive under its path relative to basedir,
+// returning its manifest entry.
+func addFileToZip(zipWriter *zip.Writer, basedir string, filename string) (manifestEntry, error) {
+
+	var entry manifestEntry
 
 	fileToZip, err := os.Open(filename)
 	if err != nil {
-		return err
+		return entry, err
 	}
 	defer fileToZip.Close()
 
 	// Get the file information
 	info, err := fileToZip.Stat()
 	if err != nil {
-		return err
+		return entry, err
 	}
 
 	header, err := zip.FileInfoHeader(info)
 	if err != nil {
-		return err
+		return entry, err
 	}
 
 	// Using FileInfoHeader() above only uses the basename of the file. If we want
 	// to preserve the folder structure we can overwrite this with the full path.
-	relfilename, _ := filepath.Rel(sessionConfig.ChangesetPath, filename)
+	relfilename, _ := filepath.Rel(basedir, filename)
 
 	//header.Name = filename
 	header.Name = relfilename
@@ -960,8 +1033,18 @@ func addFileToZip(zipWriter *zip.Writer, filename string) error {
 
 	writer, err := zipWriter.CreateHeader(header)
 	if err != nil {
-		return err
+		return entry, err
 	}
-	_, err = io.Copy(writer, fileToZip)
-	return err
+
+	// hash the file on its way into the archive
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(writer, hash), fileToZip); err != nil {
+		return entry, err
+	}
+
+	entry.Path = filepath.ToSlash(relfilename)
+	entry.Size = info.Size()
+	entry.Mtime = info.ModTime()
+	entry.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return entry, nil
 }
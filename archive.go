@@ -0,0 +1,406 @@
+package main
+
+// Ticket folder archives
+// createArchive zips a ticket folder into its downloads. Which files go in is decided
+// by gitignore-style rules: the folder's own downloads are always left out, then the
+// ArchiveExclude and ArchiveInclude settings, the client's caching policy and the
+// request's own include, exclude and since parameters narrow it further. Every zip
+// carries a manifest.json describing it, so clients can check and index an archive
+// without opening the templates. Archives are named by a fingerprint of their contents
+// and reused while the folder is unchanged, so downloads can be resumed and revalidated.
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const manifestName = "manifest.json"
+const archivePruneGrace = 10 * time.Minute // how long a replaced archive is kept for requests still sending it
+
+// never archived: earlier archives, uploads, trash and review packs live here. These
+// are checked on their own, before any other rules, so no "!" pattern can bring them back.
+var archiveAlwaysExclude = parseFileRules([]string{"/downloads/"})
+
+// one line of a gitignore-style pattern list
+type fileRule struct {
+	negate   bool     // "!pattern" brings back what an earlier rule left out
+	dirOnly  bool     // "pattern/" matches directories only
+	anchored bool     // a pattern containing "/" matches from the folder root
+	segments []string // the pattern split at "/", "**" matching any number of directories
+}
+
+type fileRules []fileRule
+
+func parseFileRules(patterns []string) fileRules {
+	var rules fileRules
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		var rule fileRule
+		if strings.HasPrefix(pattern, "!") {
+			rule.negate = true
+			pattern = pattern[1:]
+		}
+		if strings.HasSuffix(pattern, "/") {
+			rule.dirOnly = true
+			pattern = strings.TrimRight(pattern, "/")
+		}
+		rule.anchored = strings.Contains(pattern, "/")
+		pattern = strings.TrimPrefix(pattern, "/")
+		if pattern == "" {
+			continue
+		}
+		rule.segments = strings.Split(pattern, "/")
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], segments[0])
+	return ok && matchSegments(pattern[1:], segments[1:])
+}
+
+func (rule fileRule) matches(segments []string, isDir bool) bool {
+	if rule.dirOnly && !isDir {
+		return false
+	}
+	if rule.anchored {
+		return matchSegments(rule.segments, segments)
+	}
+	return matchSegments(rule.segments, segments[len(segments)-1:])
+}
+
+// match reports whether a folder-relative path is selected by the rules: the last
+// rule matching it, or one of the directories it is in, decides.
+func (rules fileRules) match(relpath string, isDir bool) bool {
+	segments := strings.Split(relpath, "/")
+	selected := false
+	for _, rule := range rules {
+		hit := rule.matches(segments, isDir)
+		for i := len(segments) - 1; i > 0 && !hit; i-- {
+			hit = rule.matches(segments[:i], true)
+		}
+		if hit {
+			selected = !rule.negate
+		}
+	}
+	return selected
+}
+
+// what goes into an archive
+type archiveOptions struct {
+	Include  []fileRules // a file must be selected by every one of these
+	Exclude  fileRules   // and not by this, nor by archiveAlwaysExclude
+	Since    time.Time   // and, when set, modified after it
+	MaxBytes int64       // largest total size of the files, 0 for no limit
+}
+
+// errArchiveTooLarge is returned when the files come to more than MaxBytes.
+type errArchiveTooLarge int64
+
+func (e errArchiveTooLarge) Error() string {
+	return fmt.Sprintf("archive would be %d bytes, over the limit", int64(e))
+}
+
+// excluded reports whether a folder-relative path is left out of every archive or
+// by the options' exclude rules.
+func (options archiveOptions) excluded(relpath string, isDir bool) bool {
+	return archiveAlwaysExclude.match(relpath, isDir) || options.Exclude.match(relpath, isDir)
+}
+
+// selects reports whether the options take a file, given its folder-relative path.
+func (options archiveOptions) selects(relpath string, info os.FileInfo) bool {
+	if options.excluded(relpath, false) {
+		return false
+	}
+	for _, include := range options.Include {
+		if !include.match(relpath, false) {
+			return false
+		}
+	}
+	return options.Since.IsZero() || info.ModTime().After(options.Since)
+}
+
+// newArchiveOptions starts from the rules every archive gets.
+func newArchiveOptions() archiveOptions {
+	config := sessionConfig()
+	options := archiveOptions{
+		Exclude: parseFileRules(config.ArchiveExclude),
+	}
+	if len(config.ArchiveInclude) > 0 {
+		options.Include = append(options.Include, parseFileRules(config.ArchiveInclude))
+	}
+	return options
+}
+
+// archiveFiles lists the files of a ticket folder the options select, and their total size.
+func archiveFiles(ticketdir string, options archiveOptions) ([]string, int64, error) {
+
+	var files []string
+	var total int64
+
+	root, err := ticketDir(ticketdir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	err = filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == root {
+			return nil
+		}
+		relpath, _ := filepath.Rel(root, file)
+		relpath = filepath.ToSlash(relpath)
+
+		if info.IsDir() {
+			if options.excluded(relpath, true) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !options.selects(relpath, info) {
+			return nil
+		}
+
+		files = append(files, file)
+		total += info.Size()
+		return nil
+	})
+
+	return files, total, err
+}
+
+func createArchive(ticketdir string, options archiveOptions) (string, error) {
+
+	files, total, err := archiveFiles(ticketdir, options)
+	if err != nil {
+		return "", err
+	}
+	if options.MaxBytes > 0 && total > options.MaxBytes {
+		return "", errArchiveTooLarge(total)
+	}
+
+	manifest, err := newArchiveManifest(ticketdir)
+	if err != nil {
+		return "", err
+	}
+	return writeArchive(ticketdir, "precache", files, manifest)
+}
+
+// archiveFingerprint identifies an archive by what goes into it: the manifest's ticket,
+// folder and selection, and each file's path, size and modification time.
+func archiveFingerprint(files []string, manifest archiveManifest) (string, error) {
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00%s\x00%s\n", manifest.Ticket, manifest.Folder, gBuild)
+	if manifest.Selection != nil {
+		json.NewEncoder(hash).Encode(manifest.Selection)
+	}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%s\x00%d\x00%d\n", file, info.Size(), info.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:32], nil
+}
+
+// writeArchive zips files into the folder's downloads, named by their fingerprint. If
+// that archive is already there it is reused, so a client resuming a download or
+// checking If-None-Match gets the same file back while the folder is unchanged.
+func writeArchive(theFolder, kind string, files []string, manifest archiveManifest) (string, error) {
+
+	fingerprint, err := archiveFingerprint(files, manifest)
+	if err != nil {
+		return "", err
+	}
+	output := fmt.Sprintf("%s/%s/downloads/%s-%s.zip", sessionConfig().ChangesetPath, theFolder, fingerprint, kind)
+	if _, err := os.Stat(output); err == nil {
+		return output, nil
+	}
+
+	// written aside and moved in, so a concurrent request never sends a half written zip
+	tmpfile := fmt.Sprintf("%s.%d.tmp", output, nowAsUnixMilli())
+	if err := zipFiles(tmpfile, files, manifest); err != nil {
+		os.Remove(tmpfile)
+		logMessage("zipFiles(): "+err.Error(), theFolder, "ERROR")
+		return "", err
+	}
+	if err := os.Rename(tmpfile, output); err != nil {
+		os.Remove(tmpfile)
+		return "", err
+	}
+	fmt.Println("Zipped File:", output)
+
+	pruneArchives(output, kind)
+	return output, nil
+}
+
+// pruneArchives deletes the older archives of kind beside output, each left from a
+// different selection or an earlier state of the folder. Ones written in the last
+// archivePruneGrace are kept, as another request may be about to send them.
+func pruneArchives(output, kind string) {
+
+	older, err := filepath.Glob(filepath.Join(filepath.Dir(output), "*-"+kind+".zip"))
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-archivePruneGrace)
+	for _, archive := range older {
+		if archive == filepath.Clean(output) {
+			continue
+		}
+		if info, err := os.Stat(archive); err == nil && info.ModTime().Before(cutoff) {
+			os.Remove(archive)
+		}
+	}
+}
+
+// archiveETag is the fingerprint an archive was named by.
+func archiveETag(output string) string {
+	return `"` + strings.SplitN(filepath.Base(output), "-", 2)[0] + `"`
+}
+
+// manifest.json, added to every archive
+type archiveManifest struct {
+	Ticket    string            `json:"ticket"` // "" when the folder isn't linked to one
+	Folder    string            `json:"folder"`
+	Build     string            `json:"build"`
+	Created   time.Time         `json:"created"`
+	Entries   []manifestEntry   `json:"entries"`
+	Selection *archiveSelection `json:"selection,omitempty"` // selective archives only
+}
+
+// a file in an archive
+type manifestEntry struct {
+	Path       string    `json:"path"` // its name in the zip
+	Size       int64     `json:"size"`
+	Mtime      time.Time `json:"mtime"`
+	SHA256     string    `json:"sha256"`
+	TemplateID string    `json:"templateid"` // "" for files that aren't templates
+}
+
+// newArchiveManifest starts the manifest for an archive of theFolder.
+func newArchiveManifest(theFolder string) (archiveManifest, error) {
+
+	manifest := archiveManifest{Folder: theFolder, Build: gBuild, Created: time.Now()}
+
+	var ticket sql.NullString
+	err := db.QueryRow(`select jirakey from damfolder where folder = $1`, theFolder).Scan(&ticket)
+	if err != nil && err != sql.ErrNoRows {
+		if err, ok := err.(*pq.Error); ok {
+			printMessage("[DCC] pq ERROR:", err.Code.Name())
+			logMessage("newArchiveManifest() couldn't SELECT from damfolder :"+err.Code.Name(), theFolder, "ERROR")
+		}
+		return manifest, err
+	}
+	manifest.Ticket = ticket.String
+	return manifest, nil
+}
+
+func addManifestToZip(zipWriter *zip.Writer, manifest archiveManifest) error {
+	writer, err := zipWriter.Create(manifestName)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(manifest)
+}
+
+// parseSince accepts unix milliseconds or an RFC 3339 time.
+func parseSince(s string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(0, ms*int64(time.Millisecond)), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// buildAndSendArchive serves GET /createArchive,<folder>[,<client>] as the client's
+// caching policy allows. include and exclude query parameters (repeatable) add rules,
+// and since=<unix ms or RFC 3339> asks for only the files changed after then.
+func buildAndSendArchive(w http.ResponseWriter, r *http.Request) {
+
+	params := strings.Split(r.URL.Path, ",")
+	if len(params) < 2 {
+		return
+	}
+	ticket := params[1]
+	client := ""
+	if len(params) > 2 {
+		client = params[2]
+	}
+
+	policy, err := resolvePolicy(ticket, client)
+	if err != nil {
+		http.Error(w, "buildAndSendArchive() couldn't read caching policy", http.StatusInternalServerError)
+		return
+	}
+	if !policy.Enabled {
+		http.Error(w, "caching is disabled for "+policyScope(ticket, client), http.StatusForbidden)
+		return
+	}
+
+	options := newArchiveOptions()
+	options.MaxBytes = policy.MaxArchiveBytes
+	if len(policy.Include) > 0 {
+		options.Include = append(options.Include, parseFileRules(policy.Include))
+	}
+
+	query := r.URL.Query()
+	if include := query["include"]; len(include) > 0 {
+		options.Include = append(options.Include, parseFileRules(include))
+	}
+	options.Exclude = append(options.Exclude, parseFileRules(query["exclude"])...)
+	if since := query.Get("since"); since != "" {
+		if options.Since, err = parseSince(since); err != nil {
+			http.Error(w, "buildAndSendArchive() bad since", http.StatusBadRequest)
+			return
+		}
+	}
+
+	output, err := createArchive(ticket, options)
+	switch err.(type) {
+	case nil:
+		w.Header().Set("ETag", archiveETag(output))
+		sendFile(w, r, output)
+	case errArchiveTooLarge:
+		http.Error(w, "buildAndSendArchive() "+err.Error(), http.StatusRequestEntityTooLarge)
+	default:
+		logMessage("buildAndSendArchive() "+err.Error(), ticket, "ERROR")
+		http.Error(w, "buildAndSendArchive() couldn't create archive", http.StatusInternalServerError)
+	}
+}
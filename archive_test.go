@@ -0,0 +1,185 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestFileRulesMatch(t *testing.T) {
+
+	tests := []struct {
+		patterns []string
+		relpath  string
+		isDir    bool
+		want     bool
+	}{
+		// unanchored patterns match a name at any depth
+		{[]string{"*.oet"}, "x.oet", false, true},
+		{[]string{"*.oet"}, "a/b/x.oet", false, true},
+		{[]string{"*.oet"}, "x.opt", false, false},
+
+		// a leading or inner "/" anchors the pattern to the folder root
+		{[]string{"/x.oet"}, "x.oet", false, true},
+		{[]string{"/x.oet"}, "sub/x.oet", false, false},
+		{[]string{"sub/*.oet"}, "sub/x.oet", false, true},
+		{[]string{"sub/*.oet"}, "other/sub/x.oet", false, false},
+
+		// "**" matches any number of directories, including none
+		{[]string{"docs/**/draft*"}, "docs/draft.txt", false, true},
+		{[]string{"docs/**/draft*"}, "docs/a/b/draft1.txt", false, true},
+		{[]string{"docs/**/draft*"}, "x/docs/draft.txt", false, false},
+		{[]string{"**/templates/*.oet"}, "a/b/templates/x.oet", false, true},
+		{[]string{"templates/**"}, "templates/a/x.oet", false, true},
+
+		// a trailing "/" matches directories only, and so everything in them
+		{[]string{"tmp/"}, "tmp", true, true},
+		{[]string{"tmp/"}, "tmp", false, false},
+		{[]string{"tmp/"}, "x/tmp/f.oet", false, true},
+		{[]string{"/downloads/"}, "downloads/a.zip", false, true},
+		{[]string{"/downloads/"}, "sub/downloads/a.oet", false, false},
+
+		// the substring bug this replaced: names merely containing "downloads"
+		{[]string{"/downloads/"}, "mydownloads.oet", false, false},
+		{[]string{"/downloads/"}, "downloadsx/a.oet", false, false},
+
+		// "!" brings back what an earlier rule left out; the last matching rule wins
+		{[]string{"*.bak", "!keep.bak"}, "a.bak", false, true},
+		{[]string{"*.bak", "!keep.bak"}, "x/keep.bak", false, false},
+		{[]string{"!keep.bak", "*.bak"}, "keep.bak", false, true},
+
+		// blank lines and comments are ignored
+		{[]string{"", "  ", "# *.oet"}, "x.oet", false, false},
+	}
+
+	for _, test := range tests {
+		if got := parseFileRules(test.patterns).match(test.relpath, test.isDir); got != test.want {
+			t.Errorf("%q match(%q, %t) = %t, want %t", test.patterns, test.relpath, test.isDir, got, test.want)
+		}
+	}
+}
+
+func TestArchiveFilesAlwaysExcludesDownloads(t *testing.T) {
+
+	dir := t.TempDir()
+	gConfig.Store(&configuration{ChangesetPath: dir})
+	defer gConfig.Store(emptyConfig)
+
+	for _, relpath := range []string{"x.oet", "mydownloads.oet", "sub/downloads/y.oet", "downloads/1-precache.zip", "downloads/trash/z.oet"} {
+		file := filepath.Join(dir, "MINE", filepath.FromSlash(relpath))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"mydownloads.oet", "sub/downloads/y.oet", "x.oet"}
+	for _, exclude := range [][]string{nil, {"!downloads/"}, {"!/downloads/", "!downloads/**"}} {
+		options := archiveOptions{Exclude: parseFileRules(exclude)}
+		files, _, err := archiveFiles("MINE", options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, file := range files {
+			relpath, _ := filepath.Rel(filepath.Join(dir, "MINE"), file)
+			got = append(got, filepath.ToSlash(relpath))
+		}
+		sort.Strings(got)
+		if len(got) != len(want) {
+			t.Errorf("exclude %q: archived %q, want %q", exclude, got, want)
+			continue
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("exclude %q: archived %q, want %q", exclude, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestWriteArchiveReusesUnchangedArchive(t *testing.T) {
+
+	dir := t.TempDir()
+	gConfig.Store(&configuration{ChangesetPath: dir})
+	defer gConfig.Store(emptyConfig)
+
+	file := filepath.Join(dir, "MINE", "x.oet")
+	if err := os.MkdirAll(filepath.Join(dir, "MINE", "downloads"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	manifest := archiveManifest{Folder: "MINE"}
+
+	first, err := writeArchive("MINE", "precache", []string{file}, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(first)
+	again, err := writeArchive("MINE", "precache", []string{file}, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != first {
+		t.Errorf("unchanged folder archived to %s, then %s", first, again)
+	}
+	if info2, _ := os.Stat(again); !info2.ModTime().Equal(info.ModTime()) {
+		t.Errorf("unchanged archive was rewritten")
+	}
+
+	if err := os.WriteFile(file, []byte("xy"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := writeArchive("MINE", "precache", []string{file}, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed == first || archiveETag(changed) == archiveETag(first) {
+		t.Errorf("changed folder reused %s", first)
+	}
+}
+
+func TestWriteArchivePrunesOlderArchives(t *testing.T) {
+
+	dir := t.TempDir()
+	gConfig.Store(&configuration{ChangesetPath: dir})
+	defer gConfig.Store(emptyConfig)
+
+	downloads := filepath.Join(dir, "MINE", "downloads")
+	if err := os.MkdirAll(downloads, 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "MINE", "x.oet")
+	if err := os.WriteFile(file, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// an hour-old archive of each kind, and one written just now
+	stale := time.Now().Add(-time.Hour)
+	for _, name := range []string{"aaaa-precache.zip", "bbbb-selection.zip", "cccc-precache.zip"} {
+		path := filepath.Join(downloads, name)
+		if err := os.WriteFile(path, []byte("zip"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if name != "cccc-precache.zip" {
+			os.Chtimes(path, stale, stale)
+		}
+	}
+
+	output, err := writeArchive("MINE", "precache", []string{file}, archiveManifest{Folder: "MINE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"aaaa-precache.zip": false, "bbbb-selection.zip": true, "cccc-precache.zip": true, filepath.Base(output): true} {
+		if _, err := os.Stat(filepath.Join(downloads, name)); (err == nil) != want {
+			t.Errorf("%s kept = %t, want %t", name, err == nil, want)
+		}
+	}
+}
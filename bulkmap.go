@@ -0,0 +1,190 @@
+package main
+
+// Bulk mirror mapping
+// The bulkmap subcommand scans the whole of MirrorCkmPath and brings mirrorstate in
+// line with it: template ids found in the mirror are inserted or pointed at their
+// current file, and rows for templates no longer in the mirror are reported as orphans.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+type bulkmapReport struct {
+	Scanned    int
+	Inserted   int
+	Updated    int
+	Unchanged  int
+	Failed     []string // files that couldn't be read, with the reason
+	Duplicates []string // template ids found in more than one file; the first path wins
+	Orphans    []string // mirrorstate rows with no template in the mirror
+}
+
+type scannedTemplate struct {
+	relpath    string
+	templateID string
+	err        error
+}
+
+// scanMirror reads the template id of every template in the mirror, in parallel.
+func scanMirror() ([]scannedTemplate, error) {
+
+	var paths []string
+	err := filepath.Walk(sessionConfig().MirrorCkmPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != sessionConfig().MirrorCkmPath && skipIndexDir(info.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isTemplateFile(path) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	scanned := make([]scannedTemplate, len(paths))
+	work := make(chan int)
+	var wg sync.WaitGroup
+
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				relpath, _ := filepath.Rel(sessionConfig().MirrorCkmPath, paths[i])
+				header, err := readTemplateHeader(paths[i])
+				if err == nil && header.TemplateID == "" {
+					err = fmt.Errorf("no template id")
+				}
+				scanned[i] = scannedTemplate{filepath.ToSlash(relpath), header.TemplateID, err}
+			}
+		}()
+	}
+	for i := range paths {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	return scanned, nil
+}
+
+// bulkMap maps every template in the mirror into mirrorstate. With dryrun nothing is
+// written, but the report is the same.
+func bulkMap(dryrun bool) (bulkmapReport, error) {
+
+	var report bulkmapReport
+
+	scanned, err := scanMirror()
+	if err != nil {
+		return report, err
+	}
+	report.Scanned = len(scanned)
+
+	existing := map[string]string{}
+	rows, err := db.Query(`select templateid, filepath from mirrorstate`)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			printMessage("[DCC] pq ERROR:", err.Code.Name())
+			logMessage("bulkMap() couldn't SELECT from mirrorstate :"+err.Code.Name(), "", "ERROR")
+		}
+		return report, err
+	}
+	for rows.Next() {
+		var templateID, path string
+		if err := rows.Scan(&templateID, &path); err != nil {
+			rows.Close()
+			return report, err
+		}
+		existing[templateID] = path
+	}
+	rows.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+
+	found := map[string]string{}
+	for _, template := range scanned {
+		if template.err != nil {
+			report.Failed = append(report.Failed, template.relpath+": "+template.err.Error())
+			continue
+		}
+		if first, ok := found[template.templateID]; ok {
+			report.Duplicates = append(report.Duplicates, template.templateID+": "+first+", "+template.relpath)
+			continue
+		}
+		found[template.templateID] = template.relpath
+
+		current, ok := existing[template.templateID]
+		switch {
+		case !ok:
+			report.Inserted++
+			if !dryrun {
+				_, err = tx.Exec(`insert into mirrorstate (templateid, filepath) values ($1, $2)`, template.templateID, template.relpath)
+			}
+		case mirrorAbsPath(current) != mirrorAbsPath(template.relpath):
+			report.Updated++
+			if !dryrun {
+				_, err = tx.Exec(`update mirrorstate set filepath = $2 where templateid = $1`, template.templateID, template.relpath)
+			}
+		default:
+			report.Unchanged++
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+
+	for templateID, path := range existing {
+		if _, ok := found[templateID]; !ok {
+			report.Orphans = append(report.Orphans, templateID+": "+path)
+		}
+	}
+	sort.Strings(report.Orphans)
+
+	if dryrun {
+		return report, nil
+	}
+	return report, tx.Commit()
+}
+
+func printBulkmapReport(report bulkmapReport, dryrun bool) {
+
+	fmt.Printf("[DCC] bulkmap: %d templates scanned, %d inserted, %d updated, %d unchanged (dry run: %t)\n",
+		report.Scanned, report.Inserted, report.Updated, report.Unchanged, dryrun)
+
+	sections := []struct {
+		title string
+		lines []string
+	}{
+		{"unreadable", report.Failed},
+		{"duplicate template ids", report.Duplicates},
+		{"orphaned mirrorstate rows", report.Orphans},
+	}
+	for _, section := range sections {
+		if len(section.lines) == 0 {
+			continue
+		}
+		fmt.Printf("[DCC] %d %s:\n", len(section.lines), section.title)
+		for _, line := range section.lines {
+			fmt.Println("    " + line)
+		}
+	}
+}
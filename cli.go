@@ -0,0 +1,347 @@
+package main
+
+// Command line
+// DAMClientCache [command] [arguments]. With no command it serves, as it always has;
+// the other commands run the same logic the HTTP handlers use, from an operator's shell.
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type cliCommand struct {
+	name    string
+	args    string
+	help    string
+	needsDB bool
+	run     func(args []string) error
+}
+
+var cliCommands []cliCommand
+
+func init() {
+	// set here rather than in the declaration, as cliHelp refers back to the table
+	cliCommands = []cliCommand{
+		{"serve", "", "serve the DAM client cache (the default)", true, cliServe},
+		{"link-ticket", "<ticket> [description] [lead] [assignee]", "link a ticket to the next free folder", true, cliLinkTicket},
+		{"close-ticket", "<ticket> <folder>", "close a ticket and empty its folder", true, cliCloseTicket},
+		{"list-tickets", "", "list the folders and the tickets linked to them", true, cliListTickets},
+		{"archive", "[-include pattern] [-exclude pattern] [-since time] [-asset id|path] [-important] <folder|ticket>", "zip a ticket folder into its downloads", true, cliArchive},
+		{"extract", "<zip> <folder|ticket>", "unzip an upload into a ticket folder", true, cliExtract},
+		{"reindex", "", "index every template and bring mirrorstate up to date", true, cliReindex},
+		{"bulkmap", "[-dryrun]", "map every mirror template into mirrorstate", true, cliBulkmap},
+		{"migratepaths", "[-dryrun]", "rewrite damasset paths into the canonical form", true, cliMigratePaths},
+		{"check-config", "", "check the configuration", false, cliCheckConfig},
+		{"db-ping", "", "check the database can be reached", false, cliDbPing},
+		{"help", "", "show this help", false, cliHelp},
+	}
+}
+
+func findCommand(name string) *cliCommand {
+	for i := range cliCommands {
+		if cliCommands[i].name == name {
+			return &cliCommands[i]
+		}
+	}
+	return nil
+}
+
+func cliHelp(args []string) error {
+	fmt.Println("DAMClientCache v" + gBuild)
+	fmt.Println("usage: DAMClientCache [command] [arguments]")
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, command := range cliCommands {
+		fmt.Fprintf(w, "  %s %s\t%s\n", command.name, command.args, command.help)
+	}
+	fmt.Fprintln(w, "  -v\tprint the version")
+	return w.Flush()
+}
+
+func cliServe(args []string) error {
+
+	loadIndex()
+	go runIndexer(indexRefreshInterval)
+	startMirrorRefresh()
+	go runChangeWatcher(changeWatchInterval)
+	go runAssetWatcher()
+	go runConfigReloader()
+
+	http.HandleFunc("/", handler)
+
+	log.Println("Listening... (" + sessionConfig().ListenPort + ")")
+
+	return http.ListenAndServe(":"+sessionConfig().ListenPort, nil)
+}
+
+// cliFolder accepts either a folder or a ticket linked to one.
+func cliFolder(arg string) (string, error) {
+	if dir, err := ticketDir(arg); err == nil {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return arg, nil
+		}
+	}
+	if folder := folderOfTicket(arg); folder != "" {
+		return folder, nil
+	}
+	return "", fmt.Errorf("%s is neither a ticket folder nor a linked ticket", arg)
+}
+
+func cliLinkTicket(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: link-ticket <ticket> [description] [lead] [assignee]")
+	}
+	for len(args) < 4 {
+		args = append(args, "")
+	}
+	folder, err := linkTicket(args[0], args[1], args[2], args[3])
+	if err != nil {
+		return err
+	}
+	fmt.Println(folder)
+	return nil
+}
+
+func cliCloseTicket(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: close-ticket <ticket> <folder>")
+	}
+	if linked := folderOfTicket(args[0]); linked != args[1] {
+		return fmt.Errorf("%s is linked to folder %q, not %q", args[0], linked, args[1])
+	}
+	return closeTicket(args[0], args[1])
+}
+
+func cliListTickets(args []string) error {
+
+	rows, err := db.Query(`
+		select df.folder, df.jirakey, coalesce(ch.description, ''),
+			coalesce(ch.active, false), coalesce(ch.state_ready, false), coalesce(ch.uploading, false)
+		from damfolder df
+		left join "change" ch on ch.jirakey = df.jirakey and df.jirakey <> ''
+		order by df.folder`)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			printMessage("[DCC] pq ERROR:", err.Code.Name())
+		}
+		return err
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FOLDER\tTICKET\tSTATE\tDESCRIPTION")
+	free := 0
+	for rows.Next() {
+		var folder, jirakey, description string
+		var active, ready, uploading bool
+		if err := rows.Scan(&folder, &jirakey, &description, &active, &ready, &uploading); err != nil {
+			return err
+		}
+		state := changeState(ready, uploading)
+		switch {
+		case jirakey == "":
+			free++
+			state = "free"
+		case !active:
+			state = "closed"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", folder, jirakey, state, description)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\n%d free folders\n", free)
+	return w.Flush()
+}
+
+func cliArchive(args []string) error {
+	var include, exclude configList
+	flags := flag.NewFlagSet("archive", flag.ContinueOnError)
+	flags.Var(&include, "include", "gitignore-style pattern a file must match (repeatable)")
+	flags.Var(&exclude, "exclude", "gitignore-style pattern to leave out (repeatable)")
+	since := flags.String("since", "", "only files changed after this unix ms or RFC 3339 time")
+	var assets configList
+	flags.Var(&assets, "asset", "archive only this resourcemainid or folder-relative path (repeatable)")
+	important := flags.Bool("important", false, "archive only the important assets, and any -asset")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: archive [-include pattern] [-exclude pattern] [-since time] [-asset id|path] [-important] <folder|ticket>")
+	}
+	folder, err := cliFolder(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	options := newArchiveOptions()
+	options.Exclude = append(options.Exclude, parseFileRules(exclude)...)
+	if len(include) > 0 {
+		options.Include = append(options.Include, parseFileRules(include))
+	}
+	if *since != "" {
+		if options.Since, err = parseSince(*since); err != nil {
+			return fmt.Errorf("archive: bad -since: %v", err)
+		}
+	}
+
+	if len(assets) > 0 || *important {
+		output, selection, err := createSelectiveArchive(folder, assets, *important, options)
+		if err != nil {
+			return err
+		}
+		for _, missing := range selection.Missing {
+			fmt.Println("[DCC] not archived: " + missing)
+		}
+		fmt.Println(output)
+		return nil
+	}
+
+	output, err := createArchive(folder, options)
+	if err != nil {
+		return err
+	}
+	fmt.Println(output)
+	return nil
+}
+
+func cliExtract(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: extract <zip> <folder|ticket>")
+	}
+	if _, err := os.Stat(args[0]); err != nil {
+		return err
+	}
+	folder, err := cliFolder(args[1])
+	if err != nil {
+		return err
+	}
+	dir, _ := ticketDir(folder)
+
+	stdout, stderr := unzipWrapper(args[0], dir+"/")
+	fmt.Print(stdout)
+	if stderr != "" {
+		return fmt.Errorf("unzip: %s", strings.TrimSpace(stderr))
+	}
+	return nil
+}
+
+func cliReindex(args []string) error {
+
+	start := time.Now()
+	changed, err := gIndex.refresh()
+	if err != nil {
+		return err
+	}
+
+	counts := map[string]int{}
+	sources := map[string]bool{}
+	for _, entry := range gIndex.find(func(*indexedTemplate) bool { return true }) {
+		counts[entry.Source]++
+		sources[entry.Source] = true
+	}
+	fmt.Printf("[DCC] reindex: %d templates indexed in %s\n", changed, time.Since(start).Round(time.Millisecond))
+	for _, source := range sortedKeys(sources) {
+		fmt.Printf("    %-20s %d\n", source, counts[source])
+	}
+
+	report, err := bulkMap(false)
+	if err != nil {
+		return err
+	}
+	printBulkmapReport(report, false)
+	return nil
+}
+
+func cliBulkmap(args []string) error {
+	dryrun := len(args) > 0 && args[0] == "-dryrun"
+	report, err := bulkMap(dryrun)
+	if err != nil {
+		return err
+	}
+	printBulkmapReport(report, dryrun)
+	return nil
+}
+
+func cliMigratePaths(args []string) error {
+	dryrun := len(args) > 0 && args[0] == "-dryrun"
+	updated, skipped, err := migrateAssetPaths(dryrun)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("[DCC] migratepaths: %d rows rewritten, %d skipped (dry run: %t)\n", updated, skipped, dryrun)
+	return nil
+}
+
+func cliCheckConfig(args []string) error {
+	fmt.Println("[DCC] " + gConfigPath)
+	printConfig(*sessionConfig())
+	problems := configProblems(*sessionConfig())
+	for _, problem := range problems {
+		fmt.Println("[DCC] " + problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems", len(problems))
+	}
+	fmt.Println("[DCC] configuration ok")
+	return nil
+}
+
+func cliDbPing(args []string) error {
+
+	conn, err := sql.Open("postgres", dbConnectionString())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if err := conn.Ping(); err != nil {
+		return err
+	}
+	fmt.Printf("[DCC] %s:%s/%s ok (%s)\n", sessionConfig().DBhost, sessionConfig().DBPort, sessionConfig().DBName, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// knownArgs sets aside the flags this build doesn't define, ahead of the command.
+// The server used to ignore any arguments it didn't recognise, and service units
+// still pass some; rather than refuse to start, unknown flags are dropped and, with
+// no command after them, the server starts as it did. A word after an unknown flag
+// is still taken as the command, so an unknown flag's value fails as one.
+func knownArgs(args []string) (known []string, ignored []string) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") || arg == "-" {
+			return append(known, args[i:]...), ignored
+		}
+		name := strings.TrimLeft(arg, "-")
+		if eq := strings.Index(name, "="); eq >= 0 {
+			name = name[:eq]
+		}
+		defined := flag.Lookup(name)
+		if defined == nil && name != "h" && name != "help" {
+			ignored = append(ignored, arg)
+			continue
+		}
+		known = append(known, arg)
+		if defined == nil || strings.Contains(arg, "=") {
+			continue
+		}
+		if boolFlag, ok := defined.Value.(interface{ IsBoolFlag() bool }); ok && boolFlag.IsBoolFlag() {
+			continue
+		}
+		if i+1 < len(args) {
+			i++ // the flag's value
+			known = append(known, args[i])
+		}
+	}
+	return known, ignored
+}
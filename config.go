@@ -0,0 +1,274 @@
+package main
+
+// Configuration
+// Read from config.json next to the executable (or the file given with -config), then
+// overridden by DCC_<FIELD> environment variables, then by -set Field=value on the
+// command line. The database password can be kept out of the JSON altogether, in the
+// file named by DBpwFile or in DCC_DBPW.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const configEnvPrefix = "DCC_"
+
+// holds the config, populated from config.json. Fields only read at startup are
+// tagged reload:"restart".
+type configuration struct {
+	DBhost                string `reload:"restart"`
+	DBusr                 string `reload:"restart"`
+	DBpw                  string `reload:"restart"` // better left empty in the JSON, see DBpwFile
+	DBpwFile              string `reload:"restart"` // file holding the database password
+	DBPort                string `reload:"restart"`
+	ListenPort            string `reload:"restart"`
+	DBName                string `reload:"restart"`
+	WorkingFolderPath     string
+	ChangesetPath         string `reload:"restart"`
+	MirrorCkmPath         string `reload:"restart"`
+	CachingEnabled        configBool
+	DebugLogging          configBool
+	DocReviewTargetDir    string
+	SupportBundlePath     string         // transform-support zip served to clients
+	SupportSourceDir      string         // when set, the bundle is rebuilt from here whenever it changes
+	ReviewStylesheet      string         // xslt used to render templates in review packs, relative to the transform support files; the only one there when ""
+	MirrorGitSource       string         `reload:"restart"` // local git repository the mirror is refreshed from; "" leaves refreshing to something else
+	MirrorGitBranch       string         // branch of MirrorGitSource to follow, its HEAD when ""
+	MirrorRefreshInterval configDuration `reload:"restart"` // how often to refresh the mirror, e.g. "90s"
+	ArchiveInclude        []string       // gitignore-style patterns an archived file must match, every file when empty
+	ArchiveExclude        []string       // gitignore-style patterns left out of every archive
+}
+
+// configBool is a boolean setting. The older "Yes" and "No" are still accepted.
+type configBool bool
+
+func parseConfigBool(s string) (configBool, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "yes", "true", "1", "on":
+		return true, nil
+	case "no", "false", "0", "off", "":
+		return false, nil
+	}
+	return false, fmt.Errorf("%q is not yes or no", s)
+}
+
+func (b *configBool) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var v bool
+		if err := json.Unmarshal(data, &v); err != nil {
+			return fmt.Errorf("%s is not yes or no", data)
+		}
+		*b = configBool(v)
+		return nil
+	}
+	v, err := parseConfigBool(s)
+	*b = v
+	return err
+}
+
+// String gives the Yes/No form clients have always been sent.
+func (b configBool) String() string {
+	if b {
+		return "Yes"
+	}
+	return "No"
+}
+
+// configDuration is a time setting written like "90s" or "5m".
+type configDuration time.Duration
+
+func (d *configDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("%s is not a duration like \"90s\"", data)
+	}
+	if s == "" {
+		*d = 0
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	*d = configDuration(v)
+	return err
+}
+
+func (d configDuration) String() string {
+	return time.Duration(d).String()
+}
+
+// setConfigField sets the named field (case doesn't matter) from its text form.
+func setConfigField(config *configuration, name, value string) error {
+
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if !strings.EqualFold(t.Field(i).Name, name) {
+			continue
+		}
+		field := v.Field(i)
+		switch field.Interface().(type) {
+		case configBool:
+			b, err := parseConfigBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", t.Field(i).Name, err)
+			}
+			field.SetBool(bool(b))
+		case configDuration:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", t.Field(i).Name, err)
+			}
+			field.SetInt(int64(d))
+		case []string:
+			var list []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			field.Set(reflect.ValueOf(list))
+		default:
+			field.SetString(value)
+		}
+		return nil
+	}
+	return fmt.Errorf("no configuration field %q", name)
+}
+
+// loadConfig reads the configuration file and applies the environment and command
+// line overrides. sets holds Field=value pairs.
+func loadConfig(filename string, sets []string) (configuration, error) {
+
+	var config configuration
+
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return config, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return config, fmt.Errorf("%s: %v", filename, err)
+	}
+	// still honoured, so older configurations keep working
+	if config.DBpw != "" {
+		println("[DCC] WARNING " + filename + ": DBpw is deprecated, move the password to DBpwFile or " + configEnvPrefix + "DBPW")
+	}
+
+	t := reflect.TypeOf(config)
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		if value, ok := os.LookupEnv(configEnvPrefix + strings.ToUpper(name)); ok {
+			if err := setConfigField(&config, name, value); err != nil {
+				return config, fmt.Errorf("%s%s: %v", configEnvPrefix, strings.ToUpper(name), err)
+			}
+		}
+	}
+
+	for _, set := range sets {
+		parts := strings.SplitN(set, "=", 2)
+		if len(parts) != 2 {
+			return config, fmt.Errorf("-set %s: expected Field=value", set)
+		}
+		if err := setConfigField(&config, parts[0], parts[1]); err != nil {
+			return config, err
+		}
+	}
+
+	// an unreadable DBpwFile is left for configProblems to report
+	if config.DBpw == "" && config.DBpwFile != "" {
+		if secret, err := os.ReadFile(config.DBpwFile); err == nil {
+			config.DBpw = strings.TrimSpace(string(secret))
+		}
+	}
+
+	return config, nil
+}
+
+// defaultConfigFile is config.json beside the executable.
+func defaultConfigFile() string {
+	dir, _ := filepath.Split(os.Args[0])
+	return filepath.Join(dir, "config.json")
+}
+
+// configList collects repeated -set flags.
+type configList []string
+
+func (l *configList) String() string     { return strings.Join(*l, ",") }
+func (l *configList) Set(s string) error { *l = append(*l, s); return nil }
+
+// configProblems lists what is wrong with the configuration.
+func configProblems(config configuration) []string {
+
+	var problems []string
+
+	dirs := []struct{ name, path string }{
+		{"MirrorCkmPath", config.MirrorCkmPath},
+		{"ChangesetPath", config.ChangesetPath},
+		{"DocReviewTargetDir", config.DocReviewTargetDir},
+	}
+	if config.SupportSourceDir != "" {
+		dirs = append(dirs, struct{ name, path string }{"SupportSourceDir", config.SupportSourceDir})
+	}
+	if config.MirrorGitSource != "" {
+		dirs = append(dirs, struct{ name, path string }{"MirrorGitSource", config.MirrorGitSource})
+	}
+	for _, dir := range dirs {
+		if dir.path == "" {
+			problems = append(problems, dir.name+" is not set")
+		} else if info, err := os.Stat(dir.path); err != nil || !info.IsDir() {
+			problems = append(problems, dir.name+" "+dir.path+" is not a directory")
+		}
+	}
+
+	ports := []struct{ name, port string }{
+		{"ListenPort", config.ListenPort},
+		{"DBPort", config.DBPort},
+	}
+	for _, p := range ports {
+		if port, err := strconv.Atoi(p.port); err != nil || port < 1 || port > 65535 {
+			problems = append(problems, p.name+" "+strconv.Quote(p.port)+" is not a port number")
+		}
+	}
+
+	if config.DBhost == "" || config.DBusr == "" || config.DBName == "" {
+		problems = append(problems, "DBhost, DBusr and DBName must all be set")
+	}
+	if config.DBpw == "" {
+		if _, err := os.Stat(config.DBpwFile); config.DBpwFile != "" && err != nil {
+			problems = append(problems, "DBpwFile "+config.DBpwFile+" can't be read")
+		} else {
+			problems = append(problems, "no database password: set DBpwFile or "+configEnvPrefix+"DBPW")
+		}
+	}
+	if config.SupportBundlePath != "" {
+		if _, err := os.Stat(filepath.Dir(config.SupportBundlePath)); err != nil {
+			problems = append(problems, "SupportBundlePath "+config.SupportBundlePath+" is not in an existing directory")
+		}
+	}
+	if config.MirrorRefreshInterval < 0 {
+		problems = append(problems, "MirrorRefreshInterval can't be negative")
+	}
+
+	return problems
+}
+
+// printConfig shows the configuration in effect, without the password.
+func printConfig(config configuration) {
+	v := reflect.ValueOf(config)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		value := fmt.Sprint(v.Field(i).Interface())
+		if t.Field(i).Name == "DBpw" && value != "" {
+			value = "********"
+		}
+		fmt.Printf("    %-22s %s\n", t.Field(i).Name, value)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+// Document review
+// Clients submit rendered review documents for a ticket. Every submission is kept as
+// a new version under DocReviewTargetDir/<ticket>/ and recorded in reviewdocument.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// a submitted version of a review document
+type reviewDocument struct {
+	ID        int64     `json:"id"`
+	Ticket    string    `json:"ticket"`
+	Docname   string    `json:"docname"`
+	Version   int       `json:"version"`
+	Submitter string    `json:"submitter"`
+	Submitted time.Time `json:"submitted"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Status    string    `json:"status"` // one of the review states below
+	Required  bool      `json:"required"`
+	filepath  string    // relative to DocReviewTargetDir
+}
+
+// review states
+const (
+	reviewSubmitted        = "submitted"
+	reviewInReview         = "in-review"
+	reviewApproved         = "approved"
+	reviewChangesRequested = "changes-requested"
+)
+
+// sanitizeDocName reduces a client supplied name to a single safe path element.
+func sanitizeDocName(name string) (string, error) {
+
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+
+	clean := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune(" ._-()", r):
+			return r
+		}
+		return '_'
+	}, name)
+
+	clean = strings.TrimLeft(strings.TrimSpace(clean), ".")
+	if clean == "" || len(clean) > 200 {
+		return "", fmt.Errorf("unusable document name %q", name)
+	}
+	return clean, nil
+}
+
+// docParam decodes a ticket or document name from the request path the way it was
+// stored, so a document is listed and looked up under the key it was submitted with.
+func docParam(param string) (string, error) {
+	name, err := url.QueryUnescape(param)
+	if err != nil {
+		return "", err
+	}
+	return sanitizeDocName(name)
+}
+
+// versionedDocName names version n of a document, e.g. "review.v3.pdf".
+func versionedDocName(docname string, version int) string {
+	ext := filepath.Ext(docname)
+	return fmt.Sprintf("%s.v%d%s", strings.TrimSuffix(docname, ext), version, ext)
+}
+
+// submitReviewDocument stores body as the next version of ticket/docname.
+// A required document must be approved before the ticket can be marked ready.
+func submitReviewDocument(ticket, docname, submitter string, required bool, body io.Reader) (reviewDocument, error) {
+
+	doc := reviewDocument{Ticket: ticket, Docname: docname, Submitter: submitter, Status: reviewSubmitted, Required: required}
+
+	dir := filepath.Join(sessionConfig().DocReviewTargetDir, ticket)
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return doc, err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return doc, err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	hash := sha256.New()
+	doc.Size, err = io.Copy(io.MultiWriter(tmp, hash), body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return doc, err
+	}
+	doc.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	doc.Submitted = time.Now()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return doc, err
+	}
+	defer tx.Rollback()
+
+	// serialize submissions of the same document so versions don't collide
+	if _, err = tx.Exec(`select pg_advisory_xact_lock(hashtext($1))`, ticket+"/"+docname); err != nil {
+		return doc, err
+	}
+	err = tx.QueryRow(`select coalesce(max(version), 0) + 1 from reviewdocument where ticket = $1 and docname = $2`, ticket, docname).Scan(&doc.Version)
+	if err != nil {
+		return doc, err
+	}
+	doc.filepath = filepath.ToSlash(filepath.Join(ticket, versionedDocName(docname, doc.Version)))
+
+	sqlStatement := `
+		INSERT INTO public.reviewdocument
+		(ticket, docname, version, filepath, submitter, submitted, size, sha256, status, required)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id`
+	err = tx.QueryRow(sqlStatement, ticket, docname, doc.Version, doc.filepath, submitter, doc.Submitted, doc.Size, doc.SHA256, doc.Status, required).Scan(&doc.ID)
+	if err != nil {
+		return doc, err
+	}
+
+	final := filepath.Join(sessionConfig().DocReviewTargetDir, filepath.FromSlash(doc.filepath))
+	if err = os.Rename(tmp.Name(), final); err != nil {
+		return doc, err
+	}
+	if err = tx.Commit(); err != nil {
+		os.Remove(final)
+		return doc, err
+	}
+
+	return doc, nil
+}
+
+// reviewDocumentHander takes POST /ReviewDocument,<ticket>,<docname>[,<submitter>[,optional]]
+// with the document as the request body. Documents are required reviews unless the
+// last parameter is "optional". The reply is the plain "N bytes are recieved." it has
+// always been, or the stored document as JSON for a client that accepts application/json.
+func reviewDocumentHander(w http.ResponseWriter, r *http.Request) {
+
+	params := strings.Split(r.RequestURI, ",")
+	if len(params) < 3 {
+		http.Error(w, "reviewDocumentHander() needs ticket and document name", http.StatusBadRequest)
+		return
+	}
+
+	ticket, err := docParam(params[1])
+	if err != nil {
+		http.Error(w, "reviewDocumentHander() bad ticket : "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	docname, err := docParam(params[2])
+	if err != nil {
+		logMessage("[DCC] reviewDocumentHander(): problems decoding document name param - "+err.Error(), ticket, "ERROR")
+		http.Error(w, "reviewDocumentHander() bad document name : "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	submitter := ""
+	if len(params) > 3 {
+		submitter, _ = url.QueryUnescape(params[3])
+	}
+	required := !(len(params) > 4 && strings.EqualFold(params[4], "optional"))
+
+	doc, err := submitReviewDocument(ticket, docname, submitter, required, r.Body)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			printMessage("[DCC] pq ERROR:", err.Code.Name())
+		}
+		logMessage("[DCC] reviewDocumentHander(): "+err.Error(), ticket, "ERROR")
+		http.Error(w, "reviewDocumentHander() couldn't store document", http.StatusInternalServerError)
+		return
+	}
+
+	logMessage(fmt.Sprintf("[DCC] reviewDocumentHander(): stored %s version %d (%d bytes)", docname, doc.Version, doc.Size), ticket, "INFO")
+
+	// existing upload clients read the plain reply; the stored document is for those asking for JSON
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, doc)
+		return
+	}
+	w.Write([]byte(fmt.Sprintf("%d bytes are recieved.\n", doc.Size)))
+}
+
+// queryReviewDocuments returns review documents matching the where clause, newest first.
+func queryReviewDocuments(where string, args ...interface{}) ([]reviewDocument, error) {
+
+	docs := []reviewDocument{}
+
+	sqlStatement := `
+		select id, ticket, docname, version, filepath, submitter, submitted, size, sha256, status, required
+		from reviewdocument ` + where + `
+		order by ticket, docname, version desc`
+
+	rows, err := db.Query(sqlStatement, args...)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			printMessage("[DCC] pq ERROR:", err.Code.Name())
+			logMessage("queryReviewDocuments() couldn't SELECT from reviewdocument :"+err.Code.Name(), "", "ERROR")
+		}
+		return docs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var doc reviewDocument
+		err = rows.Scan(&doc.ID, &doc.Ticket, &doc.Docname, &doc.Version, &doc.filepath, &doc.Submitter, &doc.Submitted, &doc.Size, &doc.SHA256, &doc.Status, &doc.Required)
+		if err != nil {
+			return docs, err
+		}
+		docs = append(docs, doc)
+	}
+
+	return docs, rows.Err()
+}
+
+// reviewDocListHandler lists every version of every document for a ticket.
+func reviewDocListHandler(w http.ResponseWriter, r *http.Request) {
+
+	params := strings.Split(r.RequestURI, ",")
+	if len(params) < 2 || params[1] == "" {
+		http.Error(w, "missing ticket", http.StatusBadRequest)
+		return
+	}
+
+	ticket, err := docParam(params[1])
+	if err != nil {
+		http.Error(w, "bad ticket", http.StatusBadRequest)
+		return
+	}
+
+	docs, err := queryReviewDocuments(`where ticket = $1`, ticket)
+	if err != nil {
+		http.Error(w, "reviewDocListHandler() couldn't read reviewdocument", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, docs)
+}
+
+// reviewDocStatusHandler reports the latest version of each document for a ticket, or
+// of one document when a name is given.
+func reviewDocStatusHandler(w http.ResponseWriter, r *http.Request) {
+
+	params := strings.Split(r.RequestURI, ",")
+	if len(params) < 2 || params[1] == "" {
+		http.Error(w, "missing ticket", http.StatusBadRequest)
+		return
+	}
+
+	where := `where ticket = $1 and version = (select max(version) from reviewdocument latest
+		where latest.ticket = reviewdocument.ticket and latest.docname = reviewdocument.docname)`
+	ticket, err := docParam(params[1])
+	if err != nil {
+		http.Error(w, "bad ticket", http.StatusBadRequest)
+		return
+	}
+	args := []interface{}{ticket}
+	if len(params) > 2 {
+		docname, err := docParam(params[2])
+		if err != nil {
+			http.Error(w, "bad document name", http.StatusBadRequest)
+			return
+		}
+		where += ` and docname = $2`
+		args = append(args, docname)
+	}
+
+	docs, err := queryReviewDocuments(where, args...)
+	if err != nil {
+		http.Error(w, "reviewDocStatusHandler() couldn't read reviewdocument", http.StatusInternalServerError)
+		return
+	}
+	if len(args) > 1 && len(docs) == 0 {
+		http.Error(w, "unknown document", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, docs)
+}
+
+// reviewDocDownloadHandler sends one stored version, by reviewdocument id.
+func reviewDocDownloadHandler(w http.ResponseWriter, r *http.Request) {
+
+	params := strings.Split(r.RequestURI, ",")
+	if len(params) < 2 {
+		http.Error(w, "missing document id", http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.ParseInt(params[1], 10, 64)
+	if err != nil {
+		http.Error(w, "bad document id", http.StatusBadRequest)
+		return
+	}
+
+	docs, err := queryReviewDocuments(`where id = $1`, id)
+	if err != nil {
+		http.Error(w, "reviewDocDownloadHandler() couldn't read reviewdocument", http.StatusInternalServerError)
+		return
+	}
+	if len(docs) == 0 {
+		http.Error(w, "unknown document", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("ETag", `"`+docs[0].SHA256+`"`)
+	sendFile(w, r, filepath.Join(sessionConfig().DocReviewTargetDir, filepath.FromSlash(docs[0].filepath)))
+}
@@ -0,0 +1,264 @@
+package main
+
+// Events
+// An in-process publish/subscribe hub. Things that clients would otherwise poll for
+// are published here as they happen, and the last few hundred are kept so a client
+// can catch up on what it missed. Clients follow them as server-sent events from
+// /events?folder=<folder>.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const eventBacklog = 500                // events kept for clients catching up
+const eventKeepAlive = 25 * time.Second // idle time before a comment is sent to keep the stream open
+const changeWatchInterval = 10 * time.Second
+
+const (
+	eventMirrorUpdate   = "mirror-update"   // the mirror moved on
+	eventFlaggedChanged = "flagged-changed" // the mirror has a new version of assets a folder flagged
+	eventChangeState    = "change-state"    // a ticket's active, ready or uploading state changed
+	eventUploadComplete = "upload-complete"
+	eventReviewDecision = "review-decision"
+	eventAssetActivity  = "asset-activity" // a template in a ticket folder was created, changed or deleted
+)
+
+type dccEvent struct {
+	ID     int64       `json:"id"`
+	Kind   string      `json:"kind"`
+	Folder string      `json:"folder,omitempty"` // the ticket folder concerned, "" for everyone
+	Time   time.Time   `json:"time"`
+	Data   interface{} `json:"data"`
+}
+
+type eventHub struct {
+	mu          sync.Mutex
+	lastID      int64
+	recent      []dccEvent
+	subscribers map[chan dccEvent]bool
+}
+
+var gEvents = newEventHub()
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: map[chan dccEvent]bool{}}
+}
+
+// publish hands an event to every subscriber. A subscriber that isn't keeping up
+// misses it, but can find it with since.
+func (hub *eventHub) publish(kind, folder string, data interface{}) dccEvent {
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	hub.lastID++
+	event := dccEvent{ID: hub.lastID, Kind: kind, Folder: folder, Time: time.Now(), Data: data}
+
+	hub.recent = append(hub.recent, event)
+	if len(hub.recent) > eventBacklog {
+		hub.recent = hub.recent[len(hub.recent)-eventBacklog:]
+	}
+
+	for ch := range hub.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+	return event
+}
+
+// subscribe returns a channel of new events and a function that ends the subscription.
+func (hub *eventHub) subscribe() (<-chan dccEvent, func()) {
+
+	ch := make(chan dccEvent, 64)
+
+	hub.mu.Lock()
+	hub.subscribers[ch] = true
+	hub.mu.Unlock()
+
+	return ch, func() {
+		hub.mu.Lock()
+		delete(hub.subscribers, ch)
+		hub.mu.Unlock()
+	}
+}
+
+// since returns the kept events after id, oldest first, and the id of the latest event.
+func (hub *eventHub) since(id int64) ([]dccEvent, int64) {
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	events := []dccEvent{}
+	for _, event := range hub.recent {
+		if event.ID > id {
+			events = append(events, event)
+		}
+	}
+	return events, hub.lastID
+}
+
+// eventsHandler streams events as server-sent events. With ?folder= only that folder's
+// events (and those for everyone) are sent. A reconnecting client gets what it missed
+// since its Last-Event-ID, or since ?since=.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	theFolder := r.URL.Query().Get("folder")
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("since")
+	}
+
+	wanted := func(event dccEvent) bool {
+		return theFolder == "" || event.Folder == "" || event.Folder == theFolder
+	}
+	send := func(event dccEvent) bool {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return true
+		}
+		if _, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Kind, data); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	events, cancel := gEvents.subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var sent int64
+	if since, err := strconv.ParseInt(lastID, 10, 64); err == nil {
+		missed, _ := gEvents.since(since)
+		for _, event := range missed {
+			if wanted(event) && !send(event) {
+				return
+			}
+			sent = event.ID
+		}
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event := <-events:
+			if event.ID <= sent || !wanted(event) {
+				continue
+			}
+			if !send(event) {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// a ticket's state as queryChangeStatus reports it
+type ticketState struct {
+	JiraKey   string `json:"jirakey"`
+	Active    bool   `json:"active"`
+	Ready     bool   `json:"ready"`
+	Uploading bool   `json:"uploading"`
+}
+
+var changeStates struct {
+	sync.Mutex
+	known  map[string]ticketState // by folder
+	loaded bool
+}
+
+// checkChangeStates reads every ticket's state and publishes the ones that changed
+// since last time. The DAM changes these as well as this server, so they are watched
+// rather than published where they're set.
+func checkChangeStates() {
+
+	// held from the query to the store, so an overlapping check can't publish
+	// transitions from an older snapshot after a newer one
+	changeStates.Lock()
+	defer changeStates.Unlock()
+
+	rows, err := db.Query(`
+		select df.folder, ch.jirakey, coalesce(ch.active, false), coalesce(ch.state_ready, false), coalesce(ch.uploading, false)
+		from "change" ch
+		join damfolder df on df.jirakey = ch.jirakey`)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			printMessage("[DCC] pq ERROR:", err.Code.Name())
+			logMessage("checkChangeStates() couldn't SELECT from change :"+err.Code.Name(), "", "ERROR")
+		}
+		return
+	}
+	defer rows.Close()
+
+	current := map[string]ticketState{}
+	for rows.Next() {
+		var folder string
+		var state ticketState
+		if err := rows.Scan(&folder, &state.JiraKey, &state.Active, &state.Ready, &state.Uploading); err != nil {
+			logMessage("checkChangeStates() "+err.Error(), "", "ERROR")
+			return
+		}
+		current[folder] = state
+	}
+	if rows.Err() != nil {
+		return
+	}
+
+	if changeStates.loaded {
+		for folder, state := range current {
+			if previous, ok := changeStates.known[folder]; !ok || previous != state {
+				gEvents.publish(eventChangeState, folder, state)
+			}
+		}
+		for folder, previous := range changeStates.known {
+			if _, ok := current[folder]; !ok {
+				previous.Active = false
+				gEvents.publish(eventChangeState, folder, previous)
+			}
+		}
+	}
+	changeStates.known = current
+	changeStates.loaded = true
+}
+
+func runChangeWatcher(interval time.Duration) {
+	for {
+		checkChangeStates()
+		time.Sleep(interval)
+	}
+}
+
+// folderOfTicket returns the folder linked to a ticket, or "" when there isn't one.
+func folderOfTicket(jirakey string) string {
+	var folder string
+	db.QueryRow(`select folder from damfolder where jirakey = $1`, jirakey).Scan(&folder)
+	return folder
+}
@@ -0,0 +1,206 @@
+package main
+
+// Important asset flagging
+// Bulk flag and unflag of damasset rows for a ticket folder. Unflagging only clears
+// importanttouser; the row, and the file, stay where they are.
+
+import (
+	"database/sql"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// an asset in a ticket folder, as held in damasset
+type importantAsset struct {
+	ResourceMainID string     `json:"resourcemainid"`
+	Filename       string     `json:"filename"`
+	Fullfilepath   string     `json:"fullfilepath"` // client form
+	Important      bool       `json:"important"`
+	Modified       bool       `json:"modified"`
+	Created        *time.Time `json:"created"`
+	Updated        *time.Time `json:"updated"`
+	State          string     `json:"state"` // "unchanged", "modified" or "missing"
+}
+
+// flagAsset marks an asset important, adding its damasset row if there isn't one yet.
+func flagAsset(tx *sql.Tx, theFolder, theTemplateID, theTemplateName string) error {
+
+	result, err := tx.Exec(`
+		update damasset set importanttouser = 1, updated = $3
+		where folder = $1 and resourcemainid = $2`, theFolder, theTemplateID, time.Now())
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		return nil
+	}
+
+	theFilePath, err := canonicalAssetPath(theFolder, theTemplateName)
+	if err != nil {
+		return err
+	}
+
+	initialmd5, initialversion, err := recordMirrorBase(theFolder, theTemplateID)
+	if err != nil {
+		return err
+	}
+
+	sqlStatement := `
+		INSERT INTO public.damasset
+		(      fullfilepath, filename, resourcemainid, initialmd5, initialversion, modified, islatest,  created, updated, importanttouser, folder)
+		VALUES(   $2,            $3,              $4,            $6,         $7,       false,  true,      $5,      $5,      1,               $1);	`
+
+	_, err = tx.Exec(sqlStatement, theFolder, theFilePath, theTemplateName, theTemplateID, time.Now(), initialmd5, initialversion)
+	return err
+}
+
+// setImportance flags or unflags every template id in the request for theFolder.
+// theTemplateID (and, when flagging, a matching theTemplateName) may be repeated.
+func setImportance(w http.ResponseWriter, r *http.Request, important bool) {
+
+	theFolder := r.FormValue("theFolder")
+	theTemplateIDs := r.Form["theTemplateID"]
+	theTemplateNames := r.Form["theTemplateName"]
+
+	if theFolder == "" || len(theTemplateIDs) == 0 {
+		http.Error(w, "setImportance() needs theFolder and at least one theTemplateID", http.StatusBadRequest)
+		return
+	}
+	if important && len(theTemplateNames) != len(theTemplateIDs) {
+		http.Error(w, "setImportance() needs a theTemplateName for every theTemplateID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logMessage("setImportance() couldn't begin transaction : "+err.Error(), theFolder, "ERROR")
+		http.Error(w, "setImportance() couldn't begin transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	for i, theTemplateID := range theTemplateIDs {
+		if important {
+			err = flagAsset(tx, theFolder, theTemplateID, theTemplateNames[i])
+		} else {
+			_, err = tx.Exec(`
+				update damasset set importanttouser = 0, updated = $3
+				where folder = $1 and resourcemainid = $2`, theFolder, theTemplateID, time.Now())
+		}
+		if err != nil {
+			if err, ok := err.(*pq.Error); ok {
+				printMessage("[DCC] pq ERROR:", err.Code.Name())
+			}
+			logMessage("setImportance() couldn't update damasset for "+theTemplateID+" : "+err.Error(), theFolder, "ERROR")
+			http.Error(w, "setImportance() couldn't update damasset", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		logMessage("setImportance() couldn't commit : "+err.Error(), theFolder, "ERROR")
+		http.Error(w, "setImportance() couldn't commit", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, struct {
+		Folder    string `json:"folder"`
+		Important bool   `json:"important"`
+		Count     int    `json:"count"`
+	}{theFolder, important, len(theTemplateIDs)})
+}
+
+func flagImportantHandler(w http.ResponseWriter, r *http.Request) {
+	setImportance(w, r, true)
+}
+
+func unflagImportantHandler(w http.ResponseWriter, r *http.Request) {
+	setImportance(w, r, false)
+}
+
+// folderAssets returns the damasset rows of a folder, optionally only the important ones,
+// with each file's current state on disk.
+func folderAssets(theFolder string, importantOnly bool) ([]importantAsset, error) {
+
+	assets := []importantAsset{}
+
+	sqlStatement := `
+		select resourcemainid, filename, fullfilepath, importanttouser = 1, coalesce(modified, false), created, updated
+		from damasset
+		where folder = $1
+		and ($2 = false or importanttouser = 1)
+		order by filename`
+
+	rows, err := db.Query(sqlStatement, theFolder, importantOnly)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			printMessage("[DCC] pq ERROR:", err.Code.Name())
+			logMessage("folderAssets() couldn't SELECT from damasset :"+err.Code.Name(), theFolder, "ERROR")
+		}
+		return assets, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var asset importantAsset
+		var created, updated pq.NullTime
+
+		err = rows.Scan(&asset.ResourceMainID, &asset.Filename, &asset.Fullfilepath, &asset.Important, &asset.Modified, &created, &updated)
+		if err != nil {
+			return assets, err
+		}
+		if created.Valid {
+			asset.Created = &created.Time
+		}
+		if updated.Valid {
+			asset.Updated = &updated.Time
+		}
+		asset.State = assetState(theFolder, asset)
+		asset.Fullfilepath = clientAssetPath(asset.Fullfilepath)
+		assets = append(assets, asset)
+	}
+
+	return assets, rows.Err()
+}
+
+// assetState compares an asset's file on disk with its damasset row.
+func assetState(theFolder string, asset importantAsset) string {
+
+	path, err := pathInTicket(theFolder, asset.Fullfilepath)
+	if err != nil {
+		return "missing"
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "missing"
+	}
+	if asset.Modified || (asset.Created != nil && info.ModTime().After(*asset.Created)) {
+		return "modified"
+	}
+	return "unchanged"
+}
+
+func importantAssetsHandler(w http.ResponseWriter, r *http.Request) {
+
+	params := strings.Split(r.RequestURI, ",")
+	if len(params) < 2 || params[1] == "" {
+		http.Error(w, "missing folder", http.StatusBadRequest)
+		return
+	}
+	theFolder := params[1]
+
+	assets, err := folderAssets(theFolder, true)
+	if err != nil {
+		http.Error(w, "importantAssetsHandler() couldn't read damasset", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, struct {
+		Folder string           `json:"folder"`
+		Assets []importantAsset `json:"assets"`
+	}{theFolder, assets})
+}
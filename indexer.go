@@ -0,0 +1,289 @@
+package main
+
+// Template index
+// An in-process index of every template under MirrorCkmPath and ChangesetPath:
+// template id -> file -> referenced archetypes. A refresh only reparses files whose
+// size or mod time changed, so it is cheap to run often.
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const indexRefreshInterval = 2 * time.Minute
+
+const mirrorSource = "mirror" // Source of templates found in the mirror
+
+// a template file known to the index
+type indexedTemplate struct {
+	templateDetail
+	Path    string    `json:"path"`   // absolute path on the server
+	Source  string    `json:"source"` // "mirror", or the ticket folder the file lives in
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modified"`
+}
+
+type templateIndex struct {
+	mu         sync.RWMutex
+	byPath     map[string]*indexedTemplate
+	byID       map[string]map[string]*indexedTemplate // template id -> path -> entry
+	generation uint64                                 // bumped whenever the index changes
+	loaded     bool                                   // a full refresh has completed
+}
+
+var gIndex = newTemplateIndex()
+
+var errIndexNotLoaded = errors.New("the template index hasn't finished loading")
+
+func newTemplateIndex() *templateIndex {
+	return &templateIndex{
+		byPath: map[string]*indexedTemplate{},
+		byID:   map[string]map[string]*indexedTemplate{},
+	}
+}
+
+// indexSource names where path lives: the mirror or a ticket folder. ok is false for
+// files outside both roots.
+func indexSource(path string) (source string, ok bool) {
+
+	if sessionConfig().MirrorCkmPath != "" {
+		if rel, err := filepath.Rel(sessionConfig().MirrorCkmPath, path); err == nil && !strings.HasPrefix(rel, "..") {
+			return mirrorSource, true
+		}
+	}
+	if sessionConfig().ChangesetPath != "" {
+		if rel, err := filepath.Rel(sessionConfig().ChangesetPath, path); err == nil && !strings.HasPrefix(rel, "..") && rel != "." {
+			return strings.Split(filepath.ToSlash(rel), "/")[0], true
+		}
+	}
+	return "", false
+}
+
+// skipIndexDir is true for directories that never hold live templates.
+func skipIndexDir(name string) bool {
+	return name == ".git" || name == "downloads"
+}
+
+// refresh walks both roots, parsing new or changed templates and dropping ones that
+// have disappeared. It returns the number of entries added, updated or removed.
+func (ix *templateIndex) refresh() (int, error) {
+
+	seen := map[string]bool{}
+	changed := 0
+
+	for _, root := range []string{sessionConfig().MirrorCkmPath, sessionConfig().ChangesetPath} {
+		if root == "" {
+			continue
+		}
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) || os.IsPermission(err) {
+					return nil
+				}
+				return err
+			}
+			if info.IsDir() {
+				if path != root && skipIndexDir(info.Name()) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !isTemplateFile(path) {
+				return nil
+			}
+			seen[path] = true
+			if ix.updateFile(path, info) {
+				changed++
+			}
+			return nil
+		})
+		if err != nil {
+			return changed, err
+		}
+	}
+
+	ix.mu.RLock()
+	var gone []string
+	for path := range ix.byPath {
+		if !seen[path] {
+			gone = append(gone, path)
+		}
+	}
+	ix.mu.RUnlock()
+
+	for _, path := range gone {
+		ix.removeFile(path)
+		changed++
+	}
+
+	ix.mu.Lock()
+	ix.loaded = true
+	ix.mu.Unlock()
+
+	return changed, nil
+}
+
+// updateFile (re)indexes a single template if it is new or has changed since it was
+// last parsed. info may be nil, in which case the file is stat'ed.
+func (ix *templateIndex) updateFile(path string, info os.FileInfo) bool {
+
+	if info == nil {
+		var err error
+		if info, err = os.Stat(path); err != nil {
+			return ix.removeFile(path)
+		}
+	}
+
+	source, ok := indexSource(path)
+	if !ok || !isTemplateFile(path) {
+		return false
+	}
+
+	ix.mu.RLock()
+	existing := ix.byPath[path]
+	ix.mu.RUnlock()
+	if existing != nil && existing.Size == info.Size() && existing.ModTime.Equal(info.ModTime()) {
+		return false
+	}
+
+	detail, err := readTemplate(path)
+	if err != nil {
+		printMessage("[DCC] index couldn't parse "+path+" : ", err.Error())
+	}
+
+	entry := &indexedTemplate{
+		templateDetail: detail,
+		Path:           path,
+		Source:         source,
+		Size:           info.Size(),
+		ModTime:        info.ModTime(),
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	ix.unlink(path)
+	ix.byPath[path] = entry
+	if entry.TemplateID != "" {
+		if ix.byID[entry.TemplateID] == nil {
+			ix.byID[entry.TemplateID] = map[string]*indexedTemplate{}
+		}
+		ix.byID[entry.TemplateID][path] = entry
+	}
+	ix.generation++
+
+	return true
+}
+
+// removeFile drops path from the index, reporting whether it was there.
+func (ix *templateIndex) removeFile(path string) bool {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if _, ok := ix.byPath[path]; !ok {
+		return false
+	}
+	ix.unlink(path)
+	ix.generation++
+	return true
+}
+
+// unlink removes path from both maps; the caller holds the write lock.
+func (ix *templateIndex) unlink(path string) {
+	old, ok := ix.byPath[path]
+	if !ok {
+		return
+	}
+	delete(ix.byPath, path)
+	if paths := ix.byID[old.TemplateID]; paths != nil {
+		delete(paths, path)
+		if len(paths) == 0 {
+			delete(ix.byID, old.TemplateID)
+		}
+	}
+}
+
+// lookup returns every copy of a template id, mirror first then by ticket folder.
+func (ix *templateIndex) lookup(templateID string) []indexedTemplate {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	var found []indexedTemplate
+	for _, entry := range ix.byID[templateID] {
+		found = append(found, *entry)
+	}
+	sortIndexed(found)
+	return found
+}
+
+// find returns every indexed template accepted by match.
+func (ix *templateIndex) find(match func(*indexedTemplate) bool) []indexedTemplate {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	var found []indexedTemplate
+	for _, entry := range ix.byPath {
+		if match(entry) {
+			found = append(found, *entry)
+		}
+	}
+	sortIndexed(found)
+	return found
+}
+
+// isLoaded reports whether the index has been filled by a full refresh, so that a
+// template missing from it is really missing.
+func (ix *templateIndex) isLoaded() bool {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.loaded
+}
+
+func (ix *templateIndex) currentGeneration() uint64 {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.generation
+}
+
+func sortIndexed(entries []indexedTemplate) {
+	sort.Slice(entries, func(i, j int) bool {
+		if (entries[i].Source == mirrorSource) != (entries[j].Source == mirrorSource) {
+			return entries[i].Source == mirrorSource
+		}
+		if entries[i].Source != entries[j].Source {
+			return entries[i].Source < entries[j].Source
+		}
+		return entries[i].Path < entries[j].Path
+	})
+}
+
+// loadIndex fills gIndex for the first time. The server only starts listening once it
+// is done, so lookups never see a half-built index.
+func loadIndex() {
+	start := time.Now()
+	changed, err := gIndex.refresh()
+	if err != nil {
+		logMessage("loadIndex() refresh failed : "+err.Error(), "", "ERROR")
+		return
+	}
+	printMessage("[DCC] index loaded,", changed, "templates in", time.Since(start))
+}
+
+// runIndexer keeps gIndex up to date, refreshing every interval.
+func runIndexer(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		start := time.Now()
+		changed, err := gIndex.refresh()
+		if err != nil {
+			logMessage("runIndexer() refresh failed : "+err.Error(), "", "ERROR")
+		} else if changed > 0 {
+			printMessage("[DCC] index refreshed,", changed, "changes in", time.Since(start))
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+// Line diff
+// A small LCS based line diff, used to show a ticket template's changes from the
+// mirror in review packs.
+
+import (
+	"os"
+	"strings"
+)
+
+const diffContext = 3        // unchanged lines shown around each change
+const diffMaxCells = 4000000 // largest LCS table attempted; beyond it the block is shown as replaced
+
+type diffLine struct {
+	Kind string // "same", "add", "del", or "skip" for elided unchanged lines
+	Text string
+}
+
+// diffFiles returns the changes from file a to file b with some context, or nothing
+// when they are the same.
+func diffFiles(a, b string) ([]diffLine, error) {
+	before, err := os.ReadFile(a)
+	if err != nil {
+		return nil, err
+	}
+	after, err := os.ReadFile(b)
+	if err != nil {
+		return nil, err
+	}
+	return diffText(string(before), string(after)), nil
+}
+
+func splitLines(text string) []string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+func diffText(before, after string) []diffLine {
+
+	a := splitLines(before)
+	b := splitLines(after)
+
+	// common prefix and suffix need no table
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var lines []diffLine
+	for _, line := range a[:prefix] {
+		lines = append(lines, diffLine{"same", line})
+	}
+	lines = append(lines, diffMiddle(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		lines = append(lines, diffLine{"same", line})
+	}
+
+	return trimContext(lines)
+}
+
+// diffMiddle diffs the part of the files between the common prefix and suffix.
+func diffMiddle(a, b []string) []diffLine {
+
+	var lines []diffLine
+
+	if len(a)*len(b) > diffMaxCells {
+		for _, line := range a {
+			lines = append(lines, diffLine{"del", line})
+		}
+		for _, line := range b {
+			lines = append(lines, diffLine{"add", line})
+		}
+		return lines
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, diffLine{"same", a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, diffLine{"del", a[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{"add", b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, diffLine{"del", a[i]})
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, diffLine{"add", b[j]})
+	}
+
+	return lines
+}
+
+// trimContext keeps diffContext unchanged lines either side of each change and
+// replaces longer unchanged runs with a single skip line.
+func trimContext(lines []diffLine) []diffLine {
+
+	keep := make([]bool, len(lines))
+	changed := false
+	for i, line := range lines {
+		if line.Kind == "same" {
+			continue
+		}
+		changed = true
+		for k := i - diffContext; k <= i+diffContext; k++ {
+			if k >= 0 && k < len(lines) {
+				keep[k] = true
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	var trimmed []diffLine
+	for i, line := range lines {
+		if keep[i] {
+			trimmed = append(trimmed, line)
+		} else if len(trimmed) == 0 || trimmed[len(trimmed)-1].Kind != "skip" {
+			trimmed = append(trimmed, diffLine{Kind: "skip"})
+		}
+	}
+	return trimmed
+}
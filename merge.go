@@ -0,0 +1,608 @@
+package main
+
+// Mirror changes under a ticket
+// When an asset is flagged, the mirror copy it started from is recorded: its md5 and
+// version in damasset, and the file itself in the ticket's downloads/base folder. If
+// the mirror later changes (an emergency change, say) the ticket's copy can be
+// three-way merged from that base, the mirror version and the ticket version.
+
+import (
+	"bytes"
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// a flagged asset whose mirror copy no longer matches the one it started from
+type mirrorChange struct {
+	ResourceMainID string `json:"resourcemainid"`
+	Filename       string `json:"filename"`
+	InitialMD5     string `json:"initialmd5"`
+	InitialVersion int64  `json:"initialversion"`
+	MirrorMD5      string `json:"mirrormd5"`
+	MirrorVersion  int64  `json:"mirrorversion"`
+	TicketModified bool   `json:"ticketmodified"` // the ticket's copy has changed too, so a merge is needed
+	HasBase        bool   `json:"hasbase"`        // the starting version was kept and a merge can be offered
+}
+
+// something both sides changed, left as the ticket has it
+type mergeConflict struct {
+	Path   string `json:"path"`
+	Field  string `json:"field"` // attribute name, "text", or "" for a whole element
+	Kind   string `json:"kind"`  // "unmergeable" when a copy holds content a merge would lose
+	Base   string `json:"base"`
+	Ticket string `json:"ticket"`
+	Mirror string `json:"mirror"`
+}
+
+type mergeResult struct {
+	TemplateID string          `json:"templateid"`
+	Clean      bool            `json:"clean"`
+	Conflicts  []mergeConflict `json:"conflicts"`
+	Merged     string          `json:"merged"`
+}
+
+func fileMD5(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// mirrorCopy returns the mirror file for a template id, or "" if the mirror hasn't got one.
+func mirrorCopy(templateID string) string {
+	for _, entry := range gIndex.lookup(templateID) {
+		if entry.Source == mirrorSource {
+			return entry.Path
+		}
+	}
+	return ""
+}
+
+// mirrorVersion numbers a mirror file by how many commits have touched it.
+func mirrorVersion(path string) int64 {
+	relpath, err := filepath.Rel(sessionConfig().MirrorCkmPath, path)
+	if err != nil {
+		return 0
+	}
+	history, err := mirrorHistory(relpath)
+	if err != nil {
+		return 0
+	}
+	return int64(len(history))
+}
+
+func baseCopyPath(theFolder, templateID string) (string, error) {
+	dir, err := ticketDir(theFolder)
+	if err != nil {
+		return "", err
+	}
+	if templateID == "" || strings.ContainsAny(templateID, `/\`) || strings.HasPrefix(templateID, ".") {
+		return "", fmt.Errorf("bad template id %q", templateID)
+	}
+	return filepath.Join(dir, "downloads", "base", templateID+".xml"), nil
+}
+
+// recordMirrorBase keeps a copy of the mirror's current version of a template as the
+// base for later merges, returning its md5 and version for damasset. A template that
+// isn't in the mirror yet has no base.
+func recordMirrorBase(theFolder, templateID string) (string, int64, error) {
+
+	// until the index is loaded every template looks new
+	if !gIndex.isLoaded() {
+		return "", 0, errIndexNotLoaded
+	}
+	source := mirrorCopy(templateID)
+	if source == "" {
+		return "", 0, nil
+	}
+
+	base, err := baseCopyPath(theFolder, templateID)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(base), 0775); err != nil {
+		return "", 0, err
+	}
+
+	content, err := os.ReadFile(source)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := os.WriteFile(base, content, 0664); err != nil {
+		return "", 0, err
+	}
+
+	sum := md5.Sum(content)
+	return hex.EncodeToString(sum[:]), mirrorVersion(source), nil
+}
+
+// unmergeableContent lists what a template holds that parseXMLTree can't keep, and
+// so a merge written from the tree would lose: comments, CDATA sections, doctype and
+// processing instructions, text mixed in with child elements, and leading or trailing
+// spaces in text.
+func unmergeableContent(path string) ([]string, error) {
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	found := map[string]bool{}
+	if bytes.Contains(content, []byte("<![CDATA[")) {
+		found["CDATA section"] = true
+	}
+
+	type element struct {
+		text     string
+		children bool
+	}
+	stack := []*element{{}}
+
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	decoder.Strict = false
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			stack[len(stack)-1].children = true
+			stack = append(stack, &element{})
+		case xml.EndElement:
+			e := stack[len(stack)-1]
+			text := strings.TrimSpace(e.text)
+			switch {
+			case text != "" && e.children:
+				found["text mixed with elements"] = true
+			case text != "" && text != e.text:
+				found["spaces around text"] = true
+			}
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			stack[len(stack)-1].text += string(t)
+		case xml.Comment:
+			found["comment"] = true
+		case xml.Directive:
+			found["doctype or directive"] = true
+		case xml.ProcInst:
+			if t.Target != "xml" || len(stack) > 1 {
+				found["processing instruction"] = true
+			}
+		}
+	}
+
+	return sortedKeys(found), nil
+}
+
+// findMirrorChanges lists the folder's assets whose mirror copy has changed since they
+// were flagged.
+func findMirrorChanges(theFolder string) ([]mirrorChange, error) {
+
+	changes := []mirrorChange{}
+
+	rows, err := db.Query(`
+		select resourcemainid, filename, fullfilepath, initialmd5, coalesce(initialversion, 0)
+		from damasset where folder = $1 and coalesce(initialmd5, '') <> ''`, theFolder)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			printMessage("[DCC] pq ERROR:", err.Code.Name())
+			logMessage("findMirrorChanges() couldn't SELECT from damasset :"+err.Code.Name(), theFolder, "ERROR")
+		}
+		return changes, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var change mirrorChange
+		var fullfilepath string
+		if err := rows.Scan(&change.ResourceMainID, &change.Filename, &fullfilepath, &change.InitialMD5, &change.InitialVersion); err != nil {
+			return changes, err
+		}
+
+		source := mirrorCopy(change.ResourceMainID)
+		if source == "" {
+			continue
+		}
+		if change.MirrorMD5, err = fileMD5(source); err != nil {
+			return changes, err
+		}
+		if change.MirrorMD5 == change.InitialMD5 {
+			continue
+		}
+		change.MirrorVersion = mirrorVersion(source)
+
+		if path, err := pathInTicket(theFolder, fullfilepath); err == nil {
+			if sum, err := fileMD5(path); err == nil {
+				change.TicketModified = sum != change.InitialMD5
+			}
+		}
+		if base, err := baseCopyPath(theFolder, change.ResourceMainID); err == nil {
+			_, err = os.Stat(base)
+			change.HasBase = err == nil
+		}
+
+		changes = append(changes, change)
+	}
+
+	return changes, rows.Err()
+}
+
+// writeXMLNode serializes a tree parsed by parseXMLTree, indenting two spaces a level.
+func writeXMLNode(buf *bytes.Buffer, n *xmlNode, depth int) {
+
+	if n.Name == "#document" {
+		if n.Prolog != "" {
+			buf.WriteString(n.Prolog + "\n")
+		}
+		for _, child := range n.Children {
+			writeXMLNode(buf, child, 0)
+		}
+		return
+	}
+
+	indent := strings.Repeat("  ", depth)
+	buf.WriteString(indent + "<" + n.Name)
+
+	names := append([]string{}, n.AttrOrder...)
+	var extra []string
+	for name := range n.Attrs {
+		if !containsString(names, name) {
+			extra = append(extra, name)
+		}
+	}
+	sort.Strings(extra)
+	for _, name := range append(names, extra...) {
+		value, ok := n.Attrs[name]
+		if !ok {
+			continue
+		}
+		buf.WriteString(" " + name + `="`)
+		xml.EscapeText(buf, []byte(value))
+		buf.WriteString(`"`)
+	}
+
+	switch {
+	case n.Text == "" && len(n.Children) == 0:
+		buf.WriteString("/>\n")
+	case len(n.Children) == 0:
+		buf.WriteString(">")
+		xml.EscapeText(buf, []byte(n.Text))
+		buf.WriteString("</" + n.Name + ">\n")
+	default:
+		buf.WriteString(">\n")
+		if n.Text != "" {
+			buf.WriteString(indent + "  ")
+			xml.EscapeText(buf, []byte(n.Text))
+			buf.WriteString("\n")
+		}
+		for _, child := range n.Children {
+			writeXMLNode(buf, child, depth+1)
+		}
+		buf.WriteString(indent + "</" + n.Name + ">\n")
+	}
+}
+
+func nodeString(n *xmlNode) string {
+	if n == nil {
+		return ""
+	}
+	var buf bytes.Buffer
+	writeXMLNode(&buf, n, 0)
+	return buf.String()
+}
+
+// pick resolves one value changed on either side. present reports whether the value
+// exists in the merged element.
+func pick(base, ticket, mirror string, inBase, inTicket, inMirror bool) (value string, present bool, conflict bool) {
+	switch {
+	case inTicket == inMirror && ticket == mirror:
+		return ticket, inTicket, false
+	case inTicket == inBase && ticket == base:
+		return mirror, inMirror, false
+	case inMirror == inBase && mirror == base:
+		return ticket, inTicket, false
+	}
+	return ticket, inTicket, true
+}
+
+// merge3 merges the mirror's changes to an element into the ticket's copy. base is nil
+// when the element was added on both sides.
+func merge3(path string, base, ticket, mirror *xmlNode, conflicts *[]mergeConflict) *xmlNode {
+
+	if base == nil {
+		base = &xmlNode{Attrs: map[string]string{}}
+	}
+	merged := &xmlNode{Name: ticket.Name, Attrs: map[string]string{}, Prolog: ticket.Prolog}
+
+	// attributes, in the ticket's order then any the mirror added
+	order := append([]string{}, ticket.AttrOrder...)
+	for _, name := range append(append([]string{}, mirror.AttrOrder...), base.AttrOrder...) {
+		if !containsString(order, name) {
+			order = append(order, name)
+		}
+	}
+	for _, name := range order {
+		b, inBase := base.Attrs[name]
+		t, inTicket := ticket.Attrs[name]
+		m, inMirror := mirror.Attrs[name]
+		value, present, conflict := pick(b, t, m, inBase, inTicket, inMirror)
+		if conflict {
+			*conflicts = append(*conflicts, mergeConflict{path, name, "attribute", b, t, m})
+		}
+		if present {
+			merged.Attrs[name] = value
+			merged.AttrOrder = append(merged.AttrOrder, name)
+		}
+	}
+
+	text, _, conflict := pick(base.Text, ticket.Text, mirror.Text, true, true, true)
+	if conflict {
+		*conflicts = append(*conflicts, mergeConflict{path, "text", "text", base.Text, ticket.Text, mirror.Text})
+	}
+	merged.Text = text
+
+	// children, in the ticket's order with the mirror's additions after their
+	// preceding sibling
+	_, baseByKey := childKeys(base)
+	ticketKeys, ticketByKey := childKeys(ticket)
+	mirrorKeys, mirrorByKey := childKeys(mirror)
+
+	keys := append([]string{}, ticketKeys...)
+	last := -1
+	for _, key := range mirrorKeys {
+		if i := indexOfString(keys, key); i >= 0 {
+			last = i
+			continue
+		}
+		last++
+		keys = append(keys[:last], append([]string{key}, keys[last:]...)...)
+	}
+
+	for _, key := range keys {
+		childPath := path + "/" + key
+		b, t, m := baseByKey[key], ticketByKey[key], mirrorByKey[key]
+
+		switch {
+		case t != nil && m != nil:
+			merged.Children = append(merged.Children, merge3(childPath, b, t, m, conflicts))
+		case t != nil && b == nil:
+			merged.Children = append(merged.Children, t) // added in the ticket
+		case t != nil:
+			// the mirror removed it; fine unless the ticket changed it
+			if nodeString(t) != nodeString(b) {
+				*conflicts = append(*conflicts, mergeConflict{childPath, "", "removed-in-mirror", nodeString(b), nodeString(t), ""})
+				merged.Children = append(merged.Children, t)
+			}
+		case m != nil && b == nil:
+			merged.Children = append(merged.Children, m) // added in the mirror
+		case m != nil:
+			// the ticket removed it; fine unless the mirror changed it
+			if nodeString(m) != nodeString(b) {
+				*conflicts = append(*conflicts, mergeConflict{childPath, "", "removed-in-ticket", nodeString(b), "", nodeString(m)})
+			}
+		}
+	}
+
+	return merged
+}
+
+func indexOfString(list []string, s string) int {
+	for i, item := range list {
+		if item == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// mergeTemplate three-way merges the mirror's changes into the ticket's copy of a template.
+func mergeTemplate(theFolder, templateID string) (mergeResult, string, error) {
+
+	result := mergeResult{TemplateID: templateID, Conflicts: []mergeConflict{}}
+
+	var fullfilepath string
+	err := db.QueryRow(`select fullfilepath from damasset where folder = $1 and resourcemainid = $2`, theFolder, templateID).Scan(&fullfilepath)
+	if err != nil {
+		return result, "", err
+	}
+	ticketPath, err := pathInTicket(theFolder, fullfilepath)
+	if err != nil {
+		return result, "", err
+	}
+	basePath, err := baseCopyPath(theFolder, templateID)
+	if err != nil {
+		return result, "", err
+	}
+	mirrorPath := mirrorCopy(templateID)
+	if mirrorPath == "" {
+		return result, "", os.ErrNotExist
+	}
+
+	base, err := parseXMLTree(basePath)
+	if err != nil {
+		return result, "", err
+	}
+	ticket, err := parseXMLTree(ticketPath)
+	if err != nil {
+		return result, "", err
+	}
+	mirror, err := parseXMLTree(mirrorPath)
+	if err != nil {
+		return result, "", err
+	}
+
+	merged := merge3("", base, ticket, mirror, &result.Conflicts)
+	result.Merged = nodeString(merged)
+
+	// the merge is written from the tree, so refuse it rather than drop what the tree lost
+	for _, side := range []string{ticketPath, mirrorPath} {
+		problems, err := unmergeableContent(side)
+		if err != nil {
+			return result, "", err
+		}
+		for _, problem := range problems {
+			conflict := mergeConflict{Kind: "unmergeable", Field: problem}
+			if side == ticketPath {
+				conflict.Ticket = problem
+			} else {
+				conflict.Mirror = problem
+			}
+			result.Conflicts = append(result.Conflicts, conflict)
+		}
+	}
+	result.Clean = len(result.Conflicts) == 0
+
+	return result, ticketPath, nil
+}
+
+func mergeParams(w http.ResponseWriter, theFolder, templateID string) (mergeResult, string, bool) {
+
+	result, ticketPath, err := mergeTemplate(theFolder, templateID)
+	switch {
+	case err == nil:
+		return result, ticketPath, true
+	case err == sql.ErrNoRows, os.IsNotExist(err):
+		http.Error(w, "no base, mirror or ticket copy of "+templateID+" to merge", http.StatusNotFound)
+	default:
+		logMessage("mergeTemplate() "+templateID+" : "+err.Error(), theFolder, "ERROR")
+		http.Error(w, "couldn't merge "+templateID+" : "+err.Error(), http.StatusInternalServerError)
+	}
+	return result, ticketPath, false
+}
+
+// mirrorChangesHandler serves GET /mirrorchanges,<folder>
+func mirrorChangesHandler(w http.ResponseWriter, r *http.Request) {
+
+	params := strings.Split(r.RequestURI, ",")
+	if len(params) < 2 || params[1] == "" {
+		http.Error(w, "missing folder", http.StatusBadRequest)
+		return
+	}
+
+	changes, err := findMirrorChanges(params[1])
+	if err != nil {
+		http.Error(w, "mirrorChangesHandler() couldn't check for mirror changes", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, changes)
+}
+
+// mergePreviewHandler serves GET /mergepreview,<folder>,<templateid>
+func mergePreviewHandler(w http.ResponseWriter, r *http.Request) {
+
+	params := strings.Split(r.RequestURI, ",")
+	if len(params) < 3 || params[1] == "" {
+		http.Error(w, "needs folder and template id", http.StatusBadRequest)
+		return
+	}
+	templateID, _ := url.QueryUnescape(params[2])
+
+	if result, _, ok := mergeParams(w, params[1], templateID); ok {
+		writeJSON(w, result)
+	}
+}
+
+// applyMergeHandler writes a clean merge over the ticket's copy, taking theFolder and
+// theTemplateID. The copy it replaces is kept in downloads/merged, and the asset's
+// base moves on to the mirror version it was merged with.
+func applyMergeHandler(w http.ResponseWriter, r *http.Request) {
+
+	theFolder := r.FormValue("theFolder")
+	theTemplateID := r.FormValue("theTemplateID")
+
+	result, ticketPath, ok := mergeParams(w, theFolder, theTemplateID)
+	if !ok {
+		return
+	}
+	if !result.Clean {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		writeJSON(w, result)
+		return
+	}
+
+	// write the merge alongside first, so a failed write leaves the ticket's copy alone
+	temp, err := os.CreateTemp(filepath.Dir(ticketPath), ".merge-*")
+	if err == nil {
+		_, err = temp.WriteString(result.Merged)
+		if closeErr := temp.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(temp.Name())
+		}
+	}
+	if err != nil {
+		logMessage("applyMergeHandler() couldn't write merge : "+err.Error(), theFolder, "ERROR")
+		http.Error(w, "applyMergeHandler() couldn't write merge", http.StatusInternalServerError)
+		return
+	}
+	os.Chmod(temp.Name(), 0664)
+
+	// never overwrite the ticket's copy without keeping it
+	dir, _ := ticketDir(theFolder)
+	backup := filepath.Join(dir, "downloads", "merged", fmt.Sprintf("%d-%s", nowAsUnixMilli(), filepath.Base(ticketPath)))
+	err = os.MkdirAll(filepath.Dir(backup), 0775)
+	if err == nil {
+		err = os.Rename(ticketPath, backup)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		logMessage("applyMergeHandler() couldn't keep previous copy, merge not applied : "+err.Error(), theFolder, "ERROR")
+		http.Error(w, "applyMergeHandler() couldn't keep the previous copy, merge not applied", http.StatusInternalServerError)
+		return
+	}
+
+	if err := os.Rename(temp.Name(), ticketPath); err != nil {
+		os.Remove(temp.Name())
+		if restoreErr := os.Rename(backup, ticketPath); restoreErr != nil {
+			logMessage("applyMergeHandler() couldn't put previous copy back from "+backup+" : "+restoreErr.Error(), theFolder, "ERROR")
+		}
+		logMessage("applyMergeHandler() couldn't write merge : "+err.Error(), theFolder, "ERROR")
+		http.Error(w, "applyMergeHandler() couldn't write merge", http.StatusInternalServerError)
+		return
+	}
+
+	initialmd5, initialversion, err := recordMirrorBase(theFolder, theTemplateID)
+	if err == nil {
+		_, err = db.Exec(`
+			update damasset set initialmd5 = $3, initialversion = $4, modified = true, updated = $5
+			where folder = $1 and resourcemainid = $2`, theFolder, theTemplateID, initialmd5, initialversion, time.Now())
+	}
+	if err != nil {
+		logMessage("applyMergeHandler() couldn't move base on : "+err.Error(), theFolder, "ERROR")
+		http.Error(w, "applyMergeHandler() merged, but couldn't record the new base", http.StatusInternalServerError)
+		return
+	}
+
+	logMessage("applyMergeHandler() merged mirror changes into "+theTemplateID, theFolder, "INFO")
+	writeJSON(w, result)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func parseXMLString(t *testing.T, content string) *xmlNode {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "t.oet")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	n, err := parseXMLTree(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+const mergeBase = `<?xml version="1.0"?>
+<template>
+  <id>t1</id>
+  <definition archetype_id="openEHR-EHR-COMPOSITION.report.v1" concept_name="Report">
+    <Rule path="/a" max="1"/>
+    <Rule path="/b" max="1"/>
+  </definition>
+</template>`
+
+func TestMerge3Clean(t *testing.T) {
+
+	ticket := strings.Replace(mergeBase, `<Rule path="/a" max="1"/>`, `<Rule path="/a" max="2"/>`, 1)
+	mirror := strings.Replace(mergeBase, `concept_name="Report"`, `concept_name="Report v2"`, 1)
+	mirror = strings.Replace(mirror, `<Rule path="/b" max="1"/>`, `<Rule path="/b" max="1"/>
+    <Rule path="/c" max="0"/>`, 1)
+
+	var conflicts []mergeConflict
+	merged := nodeString(merge3("", parseXMLString(t, mergeBase), parseXMLString(t, ticket), parseXMLString(t, mirror), &conflicts))
+
+	if len(conflicts) != 0 {
+		t.Fatalf("conflicts %+v, want none", conflicts)
+	}
+	for _, want := range []string{`<Rule path="/a" max="2"/>`, `concept_name="Report v2"`, `<Rule path="/c" max="0"/>`, `<id>t1</id>`} {
+		if !strings.Contains(merged, want) {
+			t.Errorf("merge lost %s:\n%s", want, merged)
+		}
+	}
+	if strings.Index(merged, `path="/b"`) > strings.Index(merged, `path="/c"`) {
+		t.Errorf("mirror addition not placed after its sibling:\n%s", merged)
+	}
+}
+
+func TestMerge3Conflicts(t *testing.T) {
+
+	ticket := strings.Replace(mergeBase, `<Rule path="/a" max="1"/>`, `<Rule path="/a" max="2"/>`, 1)
+	ticket = strings.Replace(ticket, `<Rule path="/b" max="1"/>`, `<Rule path="/b" max="5"/>`, 1)
+	mirror := strings.Replace(mergeBase, `<Rule path="/a" max="1"/>`, `<Rule path="/a" max="3"/>`, 1)
+	mirror = strings.Replace(mirror, `<Rule path="/b" max="1"/>`, ``, 1)
+
+	var conflicts []mergeConflict
+	merged := nodeString(merge3("", parseXMLString(t, mergeBase), parseXMLString(t, ticket), parseXMLString(t, mirror), &conflicts))
+
+	kinds := map[string]mergeConflict{}
+	for _, c := range conflicts {
+		kinds[c.Kind] = c
+	}
+	if c, ok := kinds["attribute"]; !ok || c.Field != "max" || c.Base != "1" || c.Ticket != "2" || c.Mirror != "3" {
+		t.Errorf("attribute conflict = %+v", c)
+	}
+	if _, ok := kinds["removed-in-mirror"]; !ok {
+		t.Errorf("no removed-in-mirror conflict in %+v", conflicts)
+	}
+	// conflicts keep the ticket's side
+	if !strings.Contains(merged, `<Rule path="/a" max="2"/>`) || !strings.Contains(merged, `<Rule path="/b" max="5"/>`) {
+		t.Errorf("ticket's side not kept:\n%s", merged)
+	}
+}
+
+func TestUnmergeableContent(t *testing.T) {
+
+	tests := []struct {
+		content string
+		want    []string
+	}{
+		{mergeBase, nil},
+		{`<template><!-- note --><id>t1</id></template>`, []string{"comment"}},
+		{`<template><id><![CDATA[a < b]]></id></template>`, []string{"CDATA section"}},
+		{`<template>intro<id>t1</id></template>`, []string{"text mixed with elements"}},
+		{`<template><id> t1 </id></template>`, []string{"spaces around text"}},
+		{`<?xml version="1.0"?><!DOCTYPE template><template/>`, []string{"doctype or directive"}},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "t.oet")
+		if err := os.WriteFile(path, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := unmergeableContent(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("unmergeableContent(%q) = %q, want %q", test.content, got, test.want)
+		}
+	}
+}
+
+func TestMerge3KeepsMirrorChangesAfterBase(t *testing.T) {
+
+	dir := t.TempDir()
+	mirrorDir, changesetDir := filepath.Join(dir, "mirror"), filepath.Join(dir, "changes")
+	for _, d := range []string{mirrorDir, filepath.Join(changesetDir, "MINE")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gConfig.Store(&configuration{MirrorCkmPath: mirrorDir, ChangesetPath: changesetDir})
+	defer gConfig.Store(emptyConfig)
+	saved := gIndex
+	gIndex = newTemplateIndex()
+	defer func() { gIndex = saved }()
+
+	mirrorPath := filepath.Join(mirrorDir, "t1.oet")
+	if err := os.WriteFile(mirrorPath, []byte(mergeBase), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gIndex.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := recordMirrorBase("MINE", "t1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the mirror moves on after the ticket started from it
+	mirror := strings.Replace(mergeBase, `<Rule path="/b" max="1"/>`, `<Rule path="/b" max="4"/>`, 1)
+	if err := os.WriteFile(mirrorPath, []byte(mirror), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ticket := strings.Replace(mergeBase, `<Rule path="/a" max="1"/>`, `<Rule path="/a" max="2"/>`, 1)
+
+	basePath, err := baseCopyPath("MINE", "t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conflicts []mergeConflict
+	base, err := parseXMLTree(basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := nodeString(merge3("", base, parseXMLString(t, ticket), parseXMLString(t, mirror), &conflicts))
+
+	if len(conflicts) != 0 {
+		t.Fatalf("conflicts %+v, want none", conflicts)
+	}
+	for _, want := range []string{`<Rule path="/a" max="2"/>`, `<Rule path="/b" max="4"/>`} {
+		if !strings.Contains(merged, want) {
+			t.Errorf("merge lost %s:\n%s", want, merged)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+// CKM mirror lookups
+// JSON endpoints over MirrorCkmPath and the mirrorstate table. A template can be
+// asked for by template id, by file name or by concept name.
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// a template as it exists in the mirror
+type mirrorTemplate struct {
+	TemplateID string    `json:"templateid"`
+	Concept    string    `json:"concept"`
+	Filename   string    `json:"filename"`
+	Filepath   string    `json:"filepath"` // relative to MirrorCkmPath
+	Size       int64     `json:"size"`
+	Modified   time.Time `json:"modified"`
+}
+
+// one commit in the mirror's history of a template
+type mirrorRevision struct {
+	Commit  string `json:"commit"`
+	Author  string `json:"author"`
+	Date    string `json:"date"`
+	Subject string `json:"subject"`
+}
+
+// mirrorAbsPath resolves a mirrorstate filepath, which may be stored absolute or
+// relative to the mirror.
+func mirrorAbsPath(path string) string {
+	path = filepath.FromSlash(strings.ReplaceAll(path, "\\", "/"))
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(sessionConfig().MirrorCkmPath, path)
+}
+
+// likeLiteral escapes s for use in a LIKE pattern with escape '\'.
+func likeLiteral(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func isTemplateFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".oet" || ext == ".opt"
+}
+
+// findMirrorTemplate looks key up as a template id, then as a file name, then as a
+// concept name. found is false when the mirror has no such template.
+func findMirrorTemplate(key string) (theTemplate mirrorTemplate, found bool, err error) {
+
+	var path string
+
+	err = db.QueryRow(`select filepath from mirrorstate where templateid = $1`, key).Scan(&path)
+	if err == sql.ErrNoRows {
+		// filepaths may be stored with either separator; the key is matched literally
+		name := strings.ToLower(strings.ReplaceAll(key, "\\", "/"))
+		sqlStatement := `
+			select filepath from mirrorstate
+			where replace(lower(filepath), '\', '/') like '%/' || $1 escape '\'
+			or replace(lower(filepath), '\', '/') like '%/' || $1 || '.oet' escape '\'
+			or replace(lower(filepath), '\', '/') = $2
+			limit 1`
+		err = db.QueryRow(sqlStatement, likeLiteral(name), name).Scan(&path)
+	}
+	if err == sql.ErrNoRows {
+		path, err = findMirrorFileByConcept(key)
+	}
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			printMessage("[DCC] pq ERROR:", err.Code.Name())
+			logMessage("findMirrorTemplate() couldn't SELECT from mirrorstate :"+err.Code.Name(), "", "ERROR")
+		}
+		return theTemplate, false, err
+	}
+	if path == "" {
+		return theTemplate, false, nil
+	}
+
+	fullpath := mirrorAbsPath(path)
+	info, err := os.Stat(fullpath)
+	if os.IsNotExist(err) {
+		return theTemplate, false, nil
+	}
+	if err != nil {
+		return theTemplate, false, err
+	}
+
+	header, err := readTemplateHeader(fullpath)
+	if err != nil {
+		logMessage("findMirrorTemplate() couldn't parse "+fullpath+" : "+err.Error(), "", "ERROR")
+	}
+
+	relpath, err := filepath.Rel(sessionConfig().MirrorCkmPath, fullpath)
+	if err != nil {
+		relpath = fullpath
+	}
+
+	theTemplate = mirrorTemplate{
+		TemplateID: header.TemplateID,
+		Concept:    header.Concept,
+		Filename:   filepath.Base(fullpath),
+		Filepath:   filepath.ToSlash(relpath),
+		Size:       info.Size(),
+		Modified:   info.ModTime(),
+	}
+	return theTemplate, true, nil
+}
+
+// findMirrorFileByConcept looks through the template index for a mirror template whose
+// concept name matches.
+func findMirrorFileByConcept(concept string) (string, error) {
+
+	found := gIndex.find(func(entry *indexedTemplate) bool {
+		return entry.Source == mirrorSource && strings.EqualFold(entry.Concept, concept)
+	})
+	if len(found) == 0 {
+		return "", nil
+	}
+	return found[0].Path, nil
+}
+
+// mirrorHistory returns the git log of a template in the mirror, newest first. A mirror
+// that isn't a git working copy simply has no history.
+func mirrorHistory(relpath string) ([]mirrorRevision, error) {
+
+	history := []mirrorRevision{}
+
+	if _, err := os.Stat(filepath.Join(sessionConfig().MirrorCkmPath, ".git")); err != nil {
+		return history, nil
+	}
+
+	cmd := exec.Command("git", "-C", sessionConfig().MirrorCkmPath, "log", "--follow", "--format=%H%x1f%an%x1f%aI%x1f%s", "--", relpath)
+	out, err := cmd.Output()
+	if err != nil {
+		return history, err
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(line, "\x1f")
+		if len(fields) != 4 {
+			continue
+		}
+		history = append(history, mirrorRevision{Commit: fields[0], Author: fields[1], Date: fields[2], Subject: fields[3]})
+	}
+
+	return history, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logMessage("writeJSON() failed : "+err.Error(), "", "ERROR")
+	}
+}
+
+// lookupMirrorTemplate resolves the request's key parameter, writing the error response
+// itself when the template can't be returned.
+func lookupMirrorTemplate(w http.ResponseWriter, r *http.Request) (mirrorTemplate, bool) {
+
+	params := strings.Split(r.RequestURI, ",")
+	if len(params) < 2 {
+		http.Error(w, "missing template id, filename or concept", http.StatusBadRequest)
+		return mirrorTemplate{}, false
+	}
+
+	key, err := url.QueryUnescape(params[1])
+	if err != nil {
+		http.Error(w, "bad template key: "+err.Error(), http.StatusBadRequest)
+		return mirrorTemplate{}, false
+	}
+
+	theTemplate, found, err := findMirrorTemplate(key)
+	if err != nil {
+		http.Error(w, "mirror lookup failed", http.StatusInternalServerError)
+		return theTemplate, false
+	}
+	if !found {
+		http.Error(w, "unknown template: "+key, http.StatusNotFound)
+		return theTemplate, false
+	}
+
+	return theTemplate, true
+}
+
+func mirrorTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	if theTemplate, ok := lookupMirrorTemplate(w, r); ok {
+		writeJSON(w, theTemplate)
+	}
+}
+
+func mirrorContentHandler(w http.ResponseWriter, r *http.Request) {
+
+	theTemplate, ok := lookupMirrorTemplate(w, r)
+	if !ok {
+		return
+	}
+
+	content, err := os.ReadFile(mirrorAbsPath(theTemplate.Filepath))
+	if err != nil {
+		logMessage("mirrorContentHandler() couldn't read "+theTemplate.Filepath+" : "+err.Error(), "", "ERROR")
+		http.Error(w, "couldn't read template", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, struct {
+		mirrorTemplate
+		Content string `json:"content"`
+	}{theTemplate, string(content)})
+}
+
+func mirrorHistoryHandler(w http.ResponseWriter, r *http.Request) {
+
+	theTemplate, ok := lookupMirrorTemplate(w, r)
+	if !ok {
+		return
+	}
+
+	history, err := mirrorHistory(theTemplate.Filepath)
+	if err != nil {
+		logMessage("mirrorHistoryHandler() git log failed for "+theTemplate.Filepath+" : "+err.Error(), "", "ERROR")
+		http.Error(w, "couldn't read template history", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, struct {
+		mirrorTemplate
+		History []mirrorRevision `json:"history"`
+	}{theTemplate, history})
+}
@@ -0,0 +1,16 @@
+package main
+
+import "testing"
+
+func TestLikeLiteral(t *testing.T) {
+	for s, want := range map[string]string{
+		"vital_signs":    `vital\_signs`,
+		"100%":           `100\%`,
+		`a\b`:            `a\\b`,
+		"blood pressure": "blood pressure",
+	} {
+		if got := likeLiteral(s); got != want {
+			t.Errorf("likeLiteral(%q) = %q, want %q", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+// Mirror refresh
+// Keeps MirrorCkmPath up to date from a local git repository (MirrorGitSource) on a
+// schedule, brings the mirrorstate table in line with the files that changed and
+// publishes the changed template ids, so clients needn't poll the mirror.
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const defaultMirrorRefreshInterval = time.Minute
+const mirrorUpdateWait = 55 * time.Second // how long /mirrorupdates waits for something to report
+
+// a template changed by a mirror refresh
+type mirrorUpdate struct {
+	TemplateID string `json:"templateid"`
+	Filepath   string `json:"filepath"` // relative to MirrorCkmPath
+	Change     string `json:"change"`   // "added", "modified" or "deleted"
+}
+
+type mirrorRefresh struct {
+	From      string         `json:"from"` // commits before and after
+	To        string         `json:"to"`
+	Templates []mirrorUpdate `json:"templates"`
+}
+
+var mirrorRefreshLock sync.Mutex
+
+func mirrorGit(args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", sessionConfig().MirrorCkmPath}, args...)...)
+	var outbuf, errbuf bytes.Buffer
+	cmd.Stdout = &outbuf
+	cmd.Stderr = &errbuf
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %w %s", args[0], err, strings.TrimSpace(errbuf.String()))
+	}
+	return strings.TrimSpace(outbuf.String()), nil
+}
+
+// mirrorIsAncestor is true when commit ancestor is in the history of commit descendant.
+func mirrorIsAncestor(ancestor, descendant string) (bool, error) {
+	_, err := mirrorGit("merge-base", "--is-ancestor", ancestor, descendant)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// refreshMirror fast-forwards the mirror to the source repository's branch. It returns
+// nil when there was nothing new.
+func refreshMirror() (*mirrorRefresh, error) {
+
+	mirrorRefreshLock.Lock()
+	defer mirrorRefreshLock.Unlock()
+
+	if _, err := os.Stat(filepath.Join(sessionConfig().MirrorCkmPath, ".git")); err != nil {
+		return nil, fmt.Errorf("%s is not a git working copy", sessionConfig().MirrorCkmPath)
+	}
+
+	branch := sessionConfig().MirrorGitBranch
+	if branch == "" {
+		branch = "HEAD"
+	}
+
+	from, err := mirrorGit("rev-parse", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := mirrorGit("fetch", "--quiet", sessionConfig().MirrorGitSource, branch); err != nil {
+		return nil, err
+	}
+	to, err := mirrorGit("rev-parse", "FETCH_HEAD")
+	if err != nil {
+		return nil, err
+	}
+	if from == to {
+		return nil, nil
+	}
+
+	// only a fast-forward can be published as a diff; a mirror that is ahead of the
+	// source has nothing new, and one that has diverged needs someone to look at it
+	forward, err := mirrorIsAncestor(from, to)
+	if err != nil {
+		return nil, err
+	}
+	if !forward {
+		if behind, err := mirrorIsAncestor(to, from); err == nil && behind {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("mirror at %s has diverged from %s %s, not refreshed", from, sessionConfig().MirrorGitSource, branch)
+	}
+
+	changes, err := mirrorGit("diff", "--name-status", "--no-renames", from, to)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := mirrorGit("merge", "--ff-only", "--quiet", "FETCH_HEAD"); err != nil {
+		return nil, err
+	}
+
+	refresh := &mirrorRefresh{From: from, To: to, Templates: []mirrorUpdate{}}
+
+	for _, line := range strings.Split(changes, "\n") {
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) != 2 || !isTemplateFile(fields[1]) {
+			continue
+		}
+		update := mirrorUpdate{Filepath: fields[1]}
+
+		switch fields[0] {
+		case "D":
+			update.Change = "deleted"
+			update.TemplateID, err = removeMirrorState(update.Filepath)
+		default:
+			update.Change = "modified"
+			if fields[0] == "A" {
+				update.Change = "added"
+			}
+			update.TemplateID, err = updateMirrorState(update.Filepath)
+		}
+		if err != nil {
+			logMessage("refreshMirror() couldn't update mirrorstate for "+update.Filepath+" : "+err.Error(), "", "ERROR")
+			continue
+		}
+		refresh.Templates = append(refresh.Templates, update)
+	}
+
+	if _, err := gIndex.refresh(); err != nil {
+		logMessage("refreshMirror() index refresh failed : "+err.Error(), "", "ERROR")
+	}
+
+	return refresh, nil
+}
+
+// updateMirrorState records the template id of a mirror file that was added or changed.
+func updateMirrorState(relpath string) (string, error) {
+
+	header, err := readTemplateHeader(mirrorAbsPath(relpath))
+	if err != nil {
+		return "", err
+	}
+	if header.TemplateID == "" {
+		return "", fmt.Errorf("no template id")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return header.TemplateID, err
+	}
+	defer tx.Rollback()
+
+	// a file that now holds a different template, or a template that moved
+	stored, err := mirrorStatePaths(tx, relpath)
+	if err != nil {
+		return header.TemplateID, err
+	}
+	for path, templateID := range stored {
+		if templateID == header.TemplateID {
+			continue
+		}
+		if _, err = tx.Exec(`delete from mirrorstate where filepath = $1`, path); err != nil {
+			return header.TemplateID, err
+		}
+	}
+	result, err := tx.Exec(`update mirrorstate set filepath = $2 where templateid = $1`, header.TemplateID, relpath)
+	if err != nil {
+		return header.TemplateID, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		if _, err = tx.Exec(`insert into mirrorstate (templateid, filepath) values ($1, $2)`, header.TemplateID, relpath); err != nil {
+			return header.TemplateID, err
+		}
+	}
+
+	return header.TemplateID, tx.Commit()
+}
+
+// removeMirrorState forgets a mirror file that was deleted, returning its template id.
+func removeMirrorState(relpath string) (string, error) {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	stored, err := mirrorStatePaths(tx, relpath)
+	if err != nil {
+		return "", err
+	}
+	if len(stored) == 0 {
+		return "", nil // never recorded
+	}
+
+	var templateID string
+	for path, id := range stored {
+		if _, err = tx.Exec(`delete from mirrorstate where filepath = $1`, path); err != nil {
+			if err, ok := err.(*pq.Error); ok {
+				printMessage("[DCC] pq ERROR:", err.Code.Name())
+			}
+			return "", err
+		}
+		templateID = id
+	}
+	return templateID, tx.Commit()
+}
+
+// mirrorStatePaths finds the mirrorstate rows for relpath, whichever form their
+// filepath was stored in, as stored filepath -> template id.
+func mirrorStatePaths(tx *sql.Tx, relpath string) (map[string]string, error) {
+
+	canonical, err := canonicalMirrorPath(relpath)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`select filepath, templateid from mirrorstate`)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			printMessage("[DCC] pq ERROR:", err.Code.Name())
+			logMessage("mirrorStatePaths() couldn't SELECT from mirrorstate :"+err.Code.Name(), "", "ERROR")
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	stored := map[string]string{}
+	for rows.Next() {
+		var path, templateID string
+		if err := rows.Scan(&path, &templateID); err != nil {
+			return nil, err
+		}
+		if p, err := canonicalMirrorPath(path); err == nil && p == canonical {
+			stored[path] = templateID
+		}
+	}
+	return stored, rows.Err()
+}
+
+// runMirrorRefresh refreshes the mirror every interval and publishes what changed.
+func runMirrorRefresh(interval time.Duration) {
+	for {
+		refresh, err := refreshMirror()
+		if err != nil {
+			logMessage("runMirrorRefresh() "+err.Error(), "", "ERROR")
+		} else if refresh != nil {
+			logMessage(fmt.Sprintf("runMirrorRefresh() mirror now at %s, %d templates changed", refresh.To, len(refresh.Templates)), "", "INFO")
+			gEvents.publish(eventMirrorUpdate, "", refresh)
+			publishFlaggedChanges(refresh)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// publishFlaggedChanges tells each folder which of its flagged assets the refresh
+// brought a new mirror version of.
+func publishFlaggedChanges(refresh *mirrorRefresh) {
+
+	var templateIDs []string
+	for _, update := range refresh.Templates {
+		if update.TemplateID != "" && update.Change != "deleted" {
+			templateIDs = append(templateIDs, update.TemplateID)
+		}
+	}
+	if len(templateIDs) == 0 {
+		return
+	}
+
+	rows, err := db.Query(`
+		select distinct folder from damasset
+		where importanttouser = 1 and resourcemainid = any($1)`, pq.Array(templateIDs))
+	if err != nil {
+		logMessage("publishFlaggedChanges() couldn't SELECT from damasset : "+err.Error(), "", "ERROR")
+		return
+	}
+	var folders []string
+	for rows.Next() {
+		var folder string
+		if rows.Scan(&folder) == nil {
+			folders = append(folders, folder)
+		}
+	}
+	rows.Close()
+
+	for _, folder := range folders {
+		changes, err := findMirrorChanges(folder)
+		if err != nil {
+			continue
+		}
+		var flagged []mirrorChange
+		for _, change := range changes {
+			if containsString(templateIDs, change.ResourceMainID) {
+				flagged = append(flagged, change)
+			}
+		}
+		if len(flagged) > 0 {
+			gEvents.publish(eventFlaggedChanged, folder, flagged)
+		}
+	}
+}
+
+// startMirrorRefresh starts the scheduler when a source repository is configured.
+func startMirrorRefresh() {
+
+	if sessionConfig().MirrorGitSource == "" {
+		return
+	}
+
+	interval := defaultMirrorRefreshInterval
+	if sessionConfig().MirrorRefreshInterval > 0 {
+		interval = time.Duration(sessionConfig().MirrorRefreshInterval)
+	}
+
+	go runMirrorRefresh(interval)
+}
+
+// mirrorUpdatesHandler serves GET /mirrorupdates,<last event id>. It answers with the
+// mirror updates since that event, waiting up to mirrorUpdateWait for one if there are
+// none yet.
+func mirrorUpdatesHandler(w http.ResponseWriter, r *http.Request) {
+
+	var lastID int64
+	params := strings.Split(r.RequestURI, ",")
+	if len(params) > 1 {
+		var err error
+		if lastID, err = strconv.ParseInt(params[1], 10, 64); err != nil {
+			http.Error(w, "bad event id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// subscribe before looking back, so no update falls between the two
+	events, cancel := gEvents.subscribe()
+	defer cancel()
+
+	updates := []dccEvent{}
+	recent, latest := gEvents.since(lastID)
+	for _, event := range recent {
+		if event.Kind == eventMirrorUpdate {
+			updates = append(updates, event)
+		}
+	}
+
+	timeout := time.After(mirrorUpdateWait)
+wait:
+	for len(updates) == 0 {
+		select {
+		case event := <-events:
+			if event.ID > latest {
+				latest = event.ID
+			}
+			if event.Kind == eventMirrorUpdate && event.ID > lastID {
+				updates = append(updates, event)
+			}
+		case <-timeout:
+			break wait
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	writeJSON(w, struct {
+		Latest int64      `json:"latest"`
+		Events []dccEvent `json:"events"`
+	}{latest, updates})
+}
@@ -0,0 +1,106 @@
+package main
+
+// Overlap and clash detection
+// For a ticket folder, lists every other active ticket that has a damasset row for
+// one of the folder's important assets, so an editor can see conflicts before
+// marking the ticket ready.
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// another ticket touching the same asset
+type overlappingTicket struct {
+	JiraKey   string `json:"jirakey"`
+	Folder    string `json:"folder"`
+	State     string `json:"state"` // "in-progress", "ready" or "uploading"
+	Assignee  string `json:"assignee"`
+	Important bool   `json:"important"` // the other ticket has flagged the asset too
+}
+
+type assetOverlap struct {
+	ResourceMainID string              `json:"resourcemainid"`
+	Filename       string              `json:"filename"`
+	Tickets        []overlappingTicket `json:"tickets"`
+}
+
+func changeState(ready, uploading bool) string {
+	switch {
+	case uploading:
+		return "uploading"
+	case ready:
+		return "ready"
+	}
+	return "in-progress"
+}
+
+// findOverlaps returns the folder's important assets that other active tickets also hold.
+func findOverlaps(theFolder string) ([]assetOverlap, error) {
+
+	overlaps := []assetOverlap{}
+
+	sqlStatement := `
+		select mine.resourcemainid, mine.filename,
+			ch.jirakey, other.folder, ch.state_ready, ch.uploading, coalesce(ch.jiraassignee, ''),
+			other.importanttouser = 1
+		from damasset mine
+		join damasset other on other.resourcemainid = mine.resourcemainid and other.folder <> mine.folder
+		join "change" ch on ch.folder = other.folder and ch.active = true
+		where mine.folder = $1
+		and mine.importanttouser = 1
+		order by mine.resourcemainid, ch.jirakey`
+
+	rows, err := db.Query(sqlStatement, theFolder)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			printMessage("[DCC] pq ERROR:", err.Code.Name())
+			logMessage("findOverlaps() couldn't SELECT from damasset :"+err.Code.Name(), theFolder, "ERROR")
+		}
+		return overlaps, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var resourceMainID, filename string
+		var ready, uploading bool
+		var ticket overlappingTicket
+
+		err = rows.Scan(&resourceMainID, &filename, &ticket.JiraKey, &ticket.Folder, &ready, &uploading, &ticket.Assignee, &ticket.Important)
+		if err != nil {
+			return overlaps, err
+		}
+		ticket.State = changeState(ready, uploading)
+
+		if n := len(overlaps); n == 0 || overlaps[n-1].ResourceMainID != resourceMainID {
+			overlaps = append(overlaps, assetOverlap{ResourceMainID: resourceMainID, Filename: filename})
+		}
+		last := &overlaps[len(overlaps)-1]
+		last.Tickets = append(last.Tickets, ticket)
+	}
+
+	return overlaps, rows.Err()
+}
+
+func overlapHandler(w http.ResponseWriter, r *http.Request) {
+
+	params := strings.Split(r.RequestURI, ",")
+	if len(params) < 2 || params[1] == "" {
+		http.Error(w, "missing folder", http.StatusBadRequest)
+		return
+	}
+	theFolder := params[1]
+
+	overlaps, err := findOverlaps(theFolder)
+	if err != nil {
+		http.Error(w, "overlapHandler() couldn't read overlaps", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, struct {
+		Folder   string         `json:"folder"`
+		Overlaps []assetOverlap `json:"overlaps"`
+	}{theFolder, overlaps})
+}
@@ -0,0 +1,145 @@
+package main
+
+// Asset path normalization
+// damasset.fullfilepath holds a canonical path: relative to the ticket folder, with
+// forward slashes. Windows clients send and expect backslashes, the server needs an
+// absolute path under ChangesetPath, so conversion happens only at the edges.
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// canonicalAssetPath turns any form of an asset path (client relative, server
+// absolute, or the legacy mixed-separator form) into the canonical folder-relative form.
+// An absolute path must lead into theFolder: under ChangesetPath/<theFolder>/, or, for
+// a client's own checkout, through a /<theFolder>/ directory.
+func canonicalAssetPath(theFolder, assetpath string) (string, error) {
+
+	p := strings.ReplaceAll(assetpath, "\\", "/")
+	outside := fmt.Errorf("%q is not a path inside ticket folder %s", assetpath, theFolder)
+
+	absolute := strings.HasPrefix(p, "/") || (len(p) > 1 && p[1] == ':')
+	root := strings.TrimSuffix(strings.ReplaceAll(sessionConfig().ChangesetPath, "\\", "/"), "/")
+
+	switch {
+	// server absolute: ChangesetPath/<folder>/..., and only this folder
+	case root != "" && strings.HasPrefix(p, root+"/"):
+		p = strings.TrimPrefix(p, root+"/")
+		if theFolder == "" || !strings.HasPrefix(p, theFolder+"/") {
+			return "", outside
+		}
+		p = strings.TrimPrefix(p, theFolder+"/")
+
+	// anything up to and including the ticket folder, e.g. a client's local checkout
+	case theFolder != "" && strings.HasPrefix(p, theFolder+"/"):
+		p = strings.TrimPrefix(p, theFolder+"/")
+	case theFolder != "" && strings.Contains(p, "/"+theFolder+"/"):
+		p = p[strings.Index(p, "/"+theFolder+"/")+len(theFolder)+2:]
+
+	case absolute:
+		return "", outside
+	}
+
+	p = path.Clean(strings.TrimLeft(p, "/"))
+	if p == "." || p == ".." || strings.HasPrefix(p, "../") || strings.Contains(p, ":") {
+		return "", outside
+	}
+
+	return p, nil
+}
+
+// storedAssetPath reads a damasset.fullfilepath. A path already in the canonical form
+// is final, even when it starts with, or passes through, a directory named like the
+// folder; only the legacy client and absolute forms go through canonicalAssetPath.
+func storedAssetPath(theFolder, fullfilepath string) (string, error) {
+	p := fullfilepath
+	if p != "" && p != "." && p != ".." && path.Clean(p) == p && !strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "../") && !strings.ContainsAny(p, `\:`) {
+		return p, nil
+	}
+	return canonicalAssetPath(theFolder, fullfilepath)
+}
+
+// canonicalMirrorPath turns a mirrorstate filepath, stored absolute or relative and
+// with either separator, into the form relative to MirrorCkmPath with forward slashes.
+func canonicalMirrorPath(stored string) (string, error) {
+	rel, err := filepath.Rel(sessionConfig().MirrorCkmPath, mirrorAbsPath(stored))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%q is not a path inside the mirror", stored)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// serverAssetPath is where a canonical asset path lives on this server.
+func serverAssetPath(theFolder, canonical string) (string, error) {
+	dir, err := ticketDir(theFolder)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.FromSlash(canonical)), nil
+}
+
+// clientAssetPath is the folder-relative form Windows clients work with.
+func clientAssetPath(canonical string) string {
+	return strings.ReplaceAll(canonical, "/", "\\")
+}
+
+// migrateAssetPaths rewrites every damasset.fullfilepath into the canonical form.
+// Rows whose path can't be placed inside their folder are reported and left alone.
+func migrateAssetPaths(dryrun bool) (updated int, skipped int, err error) {
+
+	rows, err := db.Query(`select folder, resourcemainid, fullfilepath from damasset`)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			printMessage("[DCC] pq ERROR:", err.Code.Name())
+			logMessage("migrateAssetPaths() couldn't SELECT from damasset :"+err.Code.Name(), "", "ERROR")
+		}
+		return 0, 0, err
+	}
+
+	type change struct{ folder, id, from, to string }
+	var changes []change
+
+	for rows.Next() {
+		var c change
+		if err := rows.Scan(&c.folder, &c.id, &c.from); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		c.to, err = storedAssetPath(c.folder, c.from)
+		if err != nil {
+			println("[DCC] migratepaths skipping " + c.folder + " " + c.id + " : " + err.Error())
+			skipped++
+			continue
+		}
+		if c.to != c.from {
+			changes = append(changes, c)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, skipped, err
+	}
+
+	for _, c := range changes {
+		println("[DCC] migratepaths " + c.folder + " : " + c.from + " -> " + c.to)
+		if dryrun {
+			updated++
+			continue
+		}
+		_, err := db.Exec(`update damasset set fullfilepath = $3 where folder = $1 and resourcemainid = $2 and fullfilepath = $4`, c.folder, c.id, c.to, c.from)
+		if err != nil {
+			return updated, skipped, err
+		}
+		updated++
+	}
+
+	if !dryrun {
+		logMessage(fmt.Sprintf("migrateAssetPaths() updated %d rows, skipped %d", updated, skipped), "", "INFO")
+	}
+	return updated, skipped, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCanonicalAssetPath(t *testing.T) {
+
+	gConfig.Store(&configuration{ChangesetPath: "/chg"})
+	defer gConfig.Store(emptyConfig)
+
+	tests := []struct {
+		assetpath string
+		want      string // "" when the path must be refused
+	}{
+		{`x.oet`, "x.oet"},
+		{`sub\x.oet`, "sub/x.oet"},
+		{`sub/./y/../x.oet`, "sub/x.oet"},
+		{`MINE/sub/x.oet`, "sub/x.oet"},
+		{`MINE\sub\x.oet`, "sub/x.oet"},
+		{`/chg/MINE/sub/x.oet`, "sub/x.oet"},
+		{`/chg/MINE/MINE/x.oet`, "MINE/x.oet"},
+		{`C:\Users\jb\MINE\sub\x.oet`, "sub/x.oet"},
+		{`/home/jb/MINE/x.oet`, "x.oet"},
+
+		{`/chg/OTHER/x.oet`, ""},
+		{`/chg/OTHER/MINE/x.oet`, ""},
+		{`/chg/x.oet`, ""},
+		{`/chg/MINE`, ""},
+		{`/etc/passwd`, ""},
+		{`C:\temp\x.oet`, ""},
+		{`C:x.oet`, ""},
+		{`../OTHER/x.oet`, ""},
+		{`sub/../../x.oet`, ""},
+		{`MINE/`, ""},
+		{``, ""},
+	}
+
+	for _, test := range tests {
+		got, err := canonicalAssetPath("MINE", test.assetpath)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("canonicalAssetPath(%q) = %q, want an error", test.assetpath, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("canonicalAssetPath(%q) = %q, %v, want %q", test.assetpath, got, err, test.want)
+		}
+	}
+}
+
+func TestPathInTicketRefusesOtherFolders(t *testing.T) {
+
+	gConfig.Store(&configuration{ChangesetPath: "/chg"})
+	defer gConfig.Store(emptyConfig)
+
+	for _, fullfilepath := range []string{`/chg/OTHER/x.oet`, `/etc/passwd`, `..\OTHER\x.oet`} {
+		if _, err := pathInTicket("MINE", fullfilepath); err != errOutsideTicket {
+			t.Errorf("pathInTicket(%q) = %v, want errOutsideTicket", fullfilepath, err)
+		}
+	}
+}
+
+func TestCanonicalMirrorPath(t *testing.T) {
+
+	gConfig.Store(&configuration{MirrorCkmPath: "/mirror"})
+	defer gConfig.Store(emptyConfig)
+
+	tests := []struct {
+		stored string
+		want   string // "" when the path must be refused
+	}{
+		{`templates/x.oet`, "templates/x.oet"},
+		{`templates\x.oet`, "templates/x.oet"},
+		{`/mirror/templates/x.oet`, "templates/x.oet"},
+		{`\mirror\templates\x.oet`, "templates/x.oet"},
+		{`/elsewhere/x.oet`, ""},
+		{`../x.oet`, ""},
+	}
+
+	for _, test := range tests {
+		got, err := canonicalMirrorPath(test.stored)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("canonicalMirrorPath(%q) = %q, want an error", test.stored, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("canonicalMirrorPath(%q) = %q, %v, want %q", test.stored, got, err, test.want)
+		}
+	}
+}
+
+func TestStoredAssetPathIsFinal(t *testing.T) {
+
+	gConfig.Store(&configuration{ChangesetPath: "/chg"})
+	defer gConfig.Store(emptyConfig)
+
+	// a subdirectory that has the folder's name
+	for _, canonical := range []string{"MINE/x.oet", "sub/MINE/x.oet", "MINE/MINE/x.oet", "x.oet"} {
+		for pass := 0; pass < 2; pass++ {
+			got, err := storedAssetPath("MINE", canonical)
+			if err != nil || got != canonical {
+				t.Errorf("storedAssetPath(%q) = %q, %v, want it unchanged", canonical, got, err)
+			}
+		}
+		path, err := pathInTicket("MINE", canonical)
+		if want := "/chg/MINE/" + canonical; err != nil || filepath.ToSlash(path) != want {
+			t.Errorf("pathInTicket(%q) = %q, %v, want %q", canonical, path, err, want)
+		}
+	}
+
+	// the server form of such a path strips only the ticket folder itself
+	if got, err := canonicalAssetPath("MINE", "/chg/MINE/MINE/x.oet"); err != nil || got != "MINE/x.oet" {
+		t.Errorf("canonicalAssetPath = %q, %v, want %q", got, err, "MINE/x.oet")
+	}
+
+	// legacy forms are still converted
+	for stored, want := range map[string]string{`MINE\sub\x.oet`: "sub/x.oet", `/chg/MINE/sub/x.oet`: "sub/x.oet", `sub\x.oet`: "sub/x.oet"} {
+		if got, err := storedAssetPath("MINE", stored); err != nil || got != want {
+			t.Errorf("storedAssetPath(%q) = %q, %v, want %q", stored, got, err, want)
+		}
+	}
+	for _, stored := range []string{"../OTHER/x.oet", "/etc/passwd", ""} {
+		if got, err := storedAssetPath("MINE", stored); err == nil {
+			t.Errorf("storedAssetPath(%q) = %q, want an error", stored, got)
+		}
+	}
+}
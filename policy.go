@@ -0,0 +1,189 @@
+package main
+
+// Caching policy
+// Whether a client caches a ticket folder, how big an archive it will take and which
+// files go in it, kept in cachingpolicy per folder and per client so a rollout can be
+// staged a team at a time. Each setting comes from the most specific row that sets
+// it: folder and client, then folder, then client, then the row for everyone, and
+// lastly CachingEnabled from the configuration.
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// the policy a client gets for a folder
+type cachingPolicy struct {
+	Folder          string   `json:"folder"`
+	Client          string   `json:"client"`
+	Enabled         bool     `json:"enabled"`
+	MaxArchiveBytes int64    `json:"maxarchivebytes"` // 0 for no limit
+	Include         []string `json:"include"`         // file patterns to archive, every file when empty
+	Sources         []string `json:"sources"`         // the rows the settings came from, most specific first
+}
+
+// policyScope names a cachingpolicy row for the Sources list.
+func policyScope(folder, client string) string {
+	switch {
+	case folder != "" && client != "":
+		return "folder " + folder + ", client " + client
+	case folder != "":
+		return "folder " + folder
+	case client != "":
+		return "client " + client
+	}
+	return "default"
+}
+
+// resolvePolicy works out the caching policy for a client of a folder.
+func resolvePolicy(theFolder, theClient string) (cachingPolicy, error) {
+
+	policy := cachingPolicy{Folder: theFolder, Client: theClient, Include: []string{}, Sources: []string{}}
+
+	// most specific first
+	rows, err := db.Query(`
+		select folder, client, enabled, maxarchivebytes, include
+		from cachingpolicy
+		where folder in ($1, '') and client in ($2, '')
+		order by (folder <> '') desc, (client <> '') desc`, theFolder, theClient)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			printMessage("[DCC] pq ERROR:", err.Code.Name())
+			logMessage("resolvePolicy() couldn't SELECT from cachingpolicy :"+err.Code.Name(), theFolder, "ERROR")
+		}
+		return policy, err
+	}
+	defer rows.Close()
+
+	var enabledSet, maxSet, includeSet bool
+	for rows.Next() {
+		var folder, client string
+		var enabled sql.NullBool
+		var maxBytes sql.NullInt64
+		var include pq.StringArray
+		if err := rows.Scan(&folder, &client, &enabled, &maxBytes, &include); err != nil {
+			return policy, err
+		}
+
+		used := false
+		if enabled.Valid && !enabledSet {
+			policy.Enabled, enabledSet, used = enabled.Bool, true, true
+		}
+		if maxBytes.Valid && !maxSet {
+			policy.MaxArchiveBytes, maxSet, used = maxBytes.Int64, true, true
+		}
+		if include != nil && !includeSet {
+			policy.Include, includeSet, used = include, true, true
+		}
+		if used {
+			policy.Sources = append(policy.Sources, policyScope(folder, client))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return policy, err
+	}
+
+	if !enabledSet {
+		policy.Enabled = bool(sessionConfig().CachingEnabled)
+		policy.Sources = append(policy.Sources, "configuration")
+	}
+	return policy, nil
+}
+
+// cachingPolicyParams reads the folder and client from /<path>,<folder>[,<client>].
+func cachingPolicyParams(r *http.Request) (string, string) {
+	params := strings.Split(r.RequestURI, ",")
+	theFolder, theClient := "", ""
+	if len(params) > 1 {
+		theFolder = params[1]
+	}
+	if len(params) > 2 {
+		theClient = params[2]
+	}
+	return theFolder, theClient
+}
+
+// isCachingEnabledHandler serves GET /isCachingEnabled[,<folder>[,<client>]]
+func isCachingEnabledHandler(w http.ResponseWriter, r *http.Request) {
+
+	theFolder, theClient := cachingPolicyParams(r)
+
+	policy, err := resolvePolicy(theFolder, theClient)
+	if err != nil {
+		http.Error(w, "isCachingEnabledHandler() couldn't read caching policy", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, policy)
+}
+
+// cachingPolicyHandler sets the policy row for theFolder and theClient, either of
+// which may be empty for "every". theEnabled, theMaxArchiveBytes and theInclude
+// (repeated) are each left unset, and so inherited, when empty.
+func cachingPolicyHandler(w http.ResponseWriter, r *http.Request) {
+
+	theFolder := r.FormValue("theFolder")
+	theClient := r.FormValue("theClient")
+
+	var enabled sql.NullBool
+	if v := r.FormValue("theEnabled"); v != "" {
+		b, err := parseConfigBool(v)
+		if err != nil {
+			http.Error(w, "cachingPolicyHandler() bad theEnabled", http.StatusBadRequest)
+			return
+		}
+		enabled = sql.NullBool{Bool: bool(b), Valid: true}
+	}
+
+	var maxBytes sql.NullInt64
+	if v := r.FormValue("theMaxArchiveBytes"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "cachingPolicyHandler() bad theMaxArchiveBytes", http.StatusBadRequest)
+			return
+		}
+		maxBytes = sql.NullInt64{Int64: n, Valid: true}
+	}
+
+	var include interface{} // NULL unless patterns are given
+	var patterns []string
+	for _, pattern := range r.Form["theInclude"] {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	if len(patterns) > 0 {
+		include = pq.Array(patterns)
+	}
+
+	sqlStatement := `
+		INSERT INTO public.cachingpolicy
+		(folder, client, enabled, maxarchivebytes, include, updated)
+		VALUES($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (folder, client) DO UPDATE
+		SET enabled = EXCLUDED.enabled, maxarchivebytes = EXCLUDED.maxarchivebytes,
+			include = EXCLUDED.include, updated = EXCLUDED.updated`
+	_, err := db.Exec(sqlStatement, theFolder, theClient, enabled, maxBytes, include, time.Now())
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			printMessage("[DCC] pq ERROR:", err.Code.Name())
+		}
+		logMessage("cachingPolicyHandler() couldn't write cachingpolicy : "+err.Error(), theFolder, "ERROR")
+		http.Error(w, "cachingPolicyHandler() couldn't write cachingpolicy", http.StatusInternalServerError)
+		return
+	}
+
+	logMessage("cachingPolicyHandler() policy set for "+policyScope(theFolder, theClient), theFolder, "INFO")
+
+	policy, err := resolvePolicy(theFolder, theClient)
+	if err != nil {
+		http.Error(w, "cachingPolicyHandler() couldn't read caching policy", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, policy)
+}
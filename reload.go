@@ -0,0 +1,131 @@
+package main
+
+// Configuration reload
+// The configuration is reloaded on SIGHUP or when its file changes. Settings read as
+// they are needed (CachingEnabled, DebugLogging, DocReviewTargetDir, ...) take effect
+// at once, by swapping in a new configuration; those only read at startup are tagged
+// reload:"restart" and keep their old value until the service is restarted.
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const configSettle = time.Second // quiet time after the config file is written before it is read
+
+var gConfig atomic.Value // *configuration, replaced whole and never changed in place
+
+var emptyConfig = &configuration{}
+
+var reloadLock sync.Mutex
+
+// sessionConfig returns the configuration in effect. It must not be modified.
+func sessionConfig() *configuration {
+	if config, ok := gConfig.Load().(*configuration); ok {
+		return config
+	}
+	return emptyConfig
+}
+
+// reloadConfig rereads the configuration and swaps it in. It returns the fields that
+// changed and those that won't change until a restart.
+func reloadConfig() (applied []string, pending []string, err error) {
+
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	loaded, err := loadConfig(gConfigPath, gConfigSets)
+	if err != nil {
+		return nil, nil, err
+	}
+	if problems := configProblems(loaded); len(problems) > 0 {
+		return nil, nil, fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+
+	current := sessionConfig()
+	next := reflect.ValueOf(&loaded).Elem()
+	previous := reflect.ValueOf(current).Elem()
+	t := next.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		if reflect.DeepEqual(next.Field(i).Interface(), previous.Field(i).Interface()) {
+			continue
+		}
+		if t.Field(i).Tag.Get("reload") == "restart" {
+			pending = append(pending, t.Field(i).Name)
+			next.Field(i).Set(previous.Field(i))
+			continue
+		}
+		applied = append(applied, t.Field(i).Name)
+	}
+
+	gConfig.Store(&loaded)
+	return applied, pending, nil
+}
+
+func logReload(reason string) {
+
+	applied, pending, err := reloadConfig()
+	if err != nil {
+		logMessage("reloadConfig() ("+reason+") kept the current configuration : "+err.Error(), "", "ERROR")
+		return
+	}
+
+	message := "reloadConfig() (" + reason + ") "
+	if len(applied) == 0 {
+		message += "no changes"
+	} else {
+		message += "applied " + strings.Join(applied, ", ")
+	}
+	logMessage(message, "", "INFO")
+	if len(pending) > 0 {
+		logMessage("reloadConfig() restart needed for "+strings.Join(pending, ", "), "", "ERROR")
+	}
+}
+
+// runConfigReloader reloads on SIGHUP and whenever the config file is written.
+func runConfigReloader() {
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	// the directory is watched, as editors often replace the file rather than write it
+	var changes <-chan fsnotify.Event
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(filepath.Dir(gConfigPath))
+	}
+	if err != nil {
+		logMessage("runConfigReloader() not watching "+gConfigPath+", reload with SIGHUP : "+err.Error(), "", "ERROR")
+	} else {
+		defer watcher.Close()
+		changes = watcher.Events
+	}
+
+	configFile := filepath.Clean(gConfigPath)
+	var settle <-chan time.Time
+
+	for {
+		select {
+		case <-hangup:
+			logReload("SIGHUP")
+		case event := <-changes:
+			if filepath.Clean(event.Name) == configFile && !event.Has(fsnotify.Chmod) {
+				settle = time.After(configSettle)
+			}
+		case <-settle:
+			settle = nil
+			logReload(filepath.Base(configFile) + " changed")
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+// Review packs
+// Renders the templates of a ticket folder into a single HTML (or PDF) document for
+// review: each template transformed with the review stylesheet from the transform
+// support files, followed by its differences from the mirror version.
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// a template section of a review pack
+type reviewSection struct {
+	TemplateID string
+	Concept    string
+	Filepath   string // relative to the ticket folder
+	Rendered   template.HTML
+	InMirror   bool
+	Diff       []diffLine
+}
+
+type reviewPack struct {
+	Folder    string
+	Generated time.Time
+	Build     string
+	Sections  []reviewSection
+}
+
+var bodyPattern = regexp.MustCompile(`(?is)<body[^>]*>(.*)</body>`)
+
+var reviewPackTemplate = template.Must(template.New("reviewpack").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Review pack {{.Folder}}</title>
+<style>
+body { font-family: sans-serif; }
+section { page-break-before: always; }
+table.diff { border-collapse: collapse; font-family: monospace; font-size: 85%; width: 100%; }
+table.diff td { white-space: pre-wrap; padding: 0 4px; vertical-align: top; }
+tr.add { background: #e6ffec; }
+tr.del { background: #ffebe9; }
+tr.skip td { color: #888; text-align: center; }
+</style>
+</head>
+<body>
+<h1>Review pack: {{.Folder}}</h1>
+<p>Generated {{.Generated.Format "2006-01-02 15:04 MST"}} by DAMClientCache v{{.Build}}</p>
+<ul>
+{{range .Sections}}<li>{{.Concept}} ({{.Filepath}})</li>
+{{end}}</ul>
+{{range .Sections}}
+<section>
+<h2>{{.Concept}}</h2>
+<p>{{.TemplateID}} &mdash; {{.Filepath}}</p>
+{{.Rendered}}
+<h3>Changes from the mirror</h3>
+{{if not .InMirror}}<p>New template: not in the mirror.</p>
+{{else if not .Diff}}<p>No changes.</p>
+{{else}}<table class="diff">
+{{range .Diff}}<tr class="{{.Kind}}"><td>{{if eq .Kind "add"}}+{{else if eq .Kind "del"}}-{{else if eq .Kind "skip"}}&hellip;{{end}}</td><td>{{.Text}}</td></tr>
+{{end}}</table>
+{{end}}
+</section>
+{{end}}
+</body>
+</html>
+`))
+
+// reviewStylesheet finds the XSLT review packs are rendered with, in the transform
+// support files: ReviewStylesheet when it is set, otherwise the only stylesheet there.
+func reviewStylesheet() (string, error) {
+
+	dir, err := supportDir()
+	if err != nil {
+		return "", err
+	}
+
+	if configured := sessionConfig().ReviewStylesheet; configured != "" {
+		stylesheet := configured
+		if !filepath.IsAbs(stylesheet) {
+			stylesheet = filepath.Join(dir, stylesheet)
+		}
+		if _, err := os.Stat(stylesheet); err != nil {
+			return "", fmt.Errorf("ReviewStylesheet %s: %v", configured, err)
+		}
+		return stylesheet, nil
+	}
+
+	var found []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			if ext := strings.ToLower(filepath.Ext(path)); ext == ".xsl" || ext == ".xslt" {
+				found = append(found, path)
+			}
+		}
+		return nil
+	})
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no .xsl or .xslt stylesheet in the transform support files %s", dir)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("%d stylesheets in the transform support files, set ReviewStylesheet to one of them", len(found))
+}
+
+// renderTemplate applies the review stylesheet to a template.
+func renderTemplate(stylesheet, path string) (template.HTML, error) {
+
+	cmd := exec.Command("xsltproc", stylesheet, path)
+	var outbuf, errbuf bytes.Buffer
+	cmd.Stdout = &outbuf
+	cmd.Stderr = &errbuf
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("xsltproc %s: %v %s", filepath.Base(path), err, errbuf.String())
+	}
+
+	// only the body of a full html document can be embedded
+	rendered := outbuf.String()
+	if match := bodyPattern.FindStringSubmatch(rendered); match != nil {
+		rendered = match[1]
+	}
+	return template.HTML(rendered), nil
+}
+
+// buildReviewPack renders every template in a ticket folder.
+func buildReviewPack(theFolder string) (reviewPack, error) {
+
+	pack := reviewPack{Folder: theFolder, Generated: time.Now(), Build: gBuild}
+
+	dir, err := ticketDir(theFolder)
+	if err != nil {
+		return pack, err
+	}
+	stylesheet, err := reviewStylesheet()
+	if err != nil {
+		logMessage("buildReviewPack() can't render templates : "+err.Error(), theFolder, "ERROR")
+		return pack, err
+	}
+	// the background refresh and the folder watcher keep the index current
+	if !gIndex.isLoaded() {
+		return pack, errIndexNotLoaded
+	}
+
+	for _, entry := range gIndex.find(func(entry *indexedTemplate) bool { return entry.Source == theFolder }) {
+		relpath, _ := filepath.Rel(dir, entry.Path)
+		section := reviewSection{TemplateID: entry.TemplateID, Concept: entry.Concept, Filepath: filepath.ToSlash(relpath)}
+		if section.Concept == "" {
+			section.Concept = filepath.Base(entry.Path)
+		}
+
+		section.Rendered, err = renderTemplate(stylesheet, entry.Path)
+		if err != nil {
+			logMessage("buildReviewPack() "+err.Error(), theFolder, "ERROR")
+			section.Rendered = template.HTML("<p>Couldn't render: " + template.HTMLEscapeString(err.Error()) + "</p>")
+		}
+
+		for _, other := range gIndex.lookup(entry.TemplateID) {
+			if other.Source == mirrorSource {
+				section.InMirror = true
+				section.Diff, err = diffFiles(other.Path, entry.Path)
+				if err != nil {
+					return pack, err
+				}
+				break
+			}
+		}
+
+		pack.Sections = append(pack.Sections, section)
+	}
+
+	return pack, nil
+}
+
+// writeReviewPack renders the pack into the folder's downloads area as html or pdf and
+// returns the file written.
+func writeReviewPack(pack reviewPack, format string) (string, error) {
+
+	dir, err := ticketDir(pack.Folder)
+	if err != nil {
+		return "", err
+	}
+	downloads := filepath.Join(dir, "downloads")
+	if err := os.MkdirAll(downloads, 0775); err != nil {
+		return "", err
+	}
+
+	output := filepath.Join(downloads, fmt.Sprintf("%d-reviewpack-%s.html", nowAsUnixMilli(), pack.Folder))
+	file, err := os.Create(output)
+	if err != nil {
+		return "", err
+	}
+	err = reviewPackTemplate.Execute(file, pack)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || format != "pdf" {
+		return output, err
+	}
+
+	pdf := strings.TrimSuffix(output, ".html") + ".pdf"
+	cmd := exec.Command("wkhtmltopdf", "--quiet", output, pdf)
+	var errbuf bytes.Buffer
+	cmd.Stderr = &errbuf
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("wkhtmltopdf: %v %s", err, errbuf.String())
+	}
+	os.Remove(output)
+	return pdf, nil
+}
+
+// reviewPackHandler serves GET /reviewpack,<folder>[,html|pdf]
+func reviewPackHandler(w http.ResponseWriter, r *http.Request) {
+
+	params := strings.Split(r.RequestURI, ",")
+	if len(params) < 2 || params[1] == "" {
+		http.Error(w, "missing folder", http.StatusBadRequest)
+		return
+	}
+	theFolder := params[1]
+	format := "html"
+	if len(params) > 2 {
+		format = strings.ToLower(params[2])
+	}
+
+	output, err := generateReviewPack(theFolder, format)
+	if err != nil {
+		http.Error(w, "reviewPackHandler() couldn't build review pack : "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendFile(w, r, output)
+}
+
+// generateReviewHandler builds a review pack and submits it as a review document for
+// the folder's ticket, taking theFolder, theFormat and theSubmitter.
+func generateReviewHandler(w http.ResponseWriter, r *http.Request) {
+
+	theFolder := r.FormValue("theFolder")
+	format := r.FormValue("theFormat")
+	if format == "" {
+		format = "html"
+	}
+
+	var ticket string
+	if err := db.QueryRow(`select jirakey from damfolder where folder = $1`, theFolder).Scan(&ticket); err != nil || ticket == "" {
+		http.Error(w, "generateReviewHandler() folder isn't linked to a ticket", http.StatusNotFound)
+		return
+	}
+
+	output, err := generateReviewPack(theFolder, format)
+	if err != nil {
+		http.Error(w, "generateReviewHandler() couldn't build review pack : "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	file, err := os.Open(output)
+	if err != nil {
+		http.Error(w, "generateReviewHandler() couldn't read review pack", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	ticket, err = sanitizeDocName(ticket)
+	if err != nil {
+		http.Error(w, "generateReviewHandler() bad ticket : "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	docname, _ := sanitizeDocName("ReviewPack-" + theFolder + filepath.Ext(output))
+	doc, err := submitReviewDocument(ticket, docname, r.FormValue("theSubmitter"), true, file)
+	if err != nil {
+		logMessage("generateReviewHandler() couldn't submit review pack : "+err.Error(), ticket, "ERROR")
+		http.Error(w, "generateReviewHandler() couldn't submit review pack", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, doc)
+}
+
+func generateReviewPack(theFolder, format string) (string, error) {
+
+	if format != "html" && format != "pdf" {
+		return "", fmt.Errorf("unknown format %q", format)
+	}
+
+	pack, err := buildReviewPack(theFolder)
+	if err != nil {
+		return "", err
+	}
+	output, err := writeReviewPack(pack, format)
+	if err != nil {
+		logMessage("generateReviewPack() "+err.Error(), theFolder, "ERROR")
+		return "", err
+	}
+
+	logMessage(fmt.Sprintf("generateReviewPack() wrote %d templates to %s", len(pack.Sections), output), theFolder, "INFO")
+	return output, nil
+}
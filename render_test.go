@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReviewStylesheet(t *testing.T) {
+
+	dir := t.TempDir()
+	defer gConfig.Store(emptyConfig)
+
+	write := func(name string) {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("<xsl:stylesheet/>"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gConfig.Store(&configuration{SupportSourceDir: dir})
+	if _, err := reviewStylesheet(); err == nil {
+		t.Errorf("no stylesheet in the support files, but no error")
+	}
+
+	write("xsl/template.xsl")
+	if got, err := reviewStylesheet(); err != nil || got != filepath.Join(dir, "xsl", "template.xsl") {
+		t.Errorf("reviewStylesheet() = %q, %v, want the bundled stylesheet", got, err)
+	}
+
+	write("xsl/archetype.xslt")
+	if _, err := reviewStylesheet(); err == nil || !strings.Contains(err.Error(), "ReviewStylesheet") {
+		t.Errorf("two stylesheets, got %v, want an error asking for ReviewStylesheet", err)
+	}
+
+	gConfig.Store(&configuration{SupportSourceDir: dir, ReviewStylesheet: "xsl/archetype.xslt"})
+	if got, err := reviewStylesheet(); err != nil || got != filepath.Join(dir, "xsl", "archetype.xslt") {
+		t.Errorf("reviewStylesheet() = %q, %v, want the configured stylesheet", got, err)
+	}
+
+	gConfig.Store(&configuration{SupportSourceDir: dir, ReviewStylesheet: "missing.xsl"})
+	if _, err := reviewStylesheet(); err == nil {
+		t.Errorf("configured stylesheet missing, but no error")
+	}
+}
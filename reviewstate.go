@@ -0,0 +1,192 @@
+package main
+
+// Review decisions
+// Reviewers move the latest version of a document through the review states, each
+// move recorded in reviewdecision against the ticket's change row. A ticket can't be
+// marked ready while any of its required documents is not approved.
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// a reviewer's decision on one document version
+type reviewDecision struct {
+	ID         int64     `json:"id"`
+	DocumentID int64     `json:"documentid"`
+	JiraKey    string    `json:"jirakey"`
+	Status     string    `json:"status"`
+	Reviewer   string    `json:"reviewer"`
+	Comment    string    `json:"comment"`
+	Decided    time.Time `json:"decided"`
+}
+
+// the states a document may move to from each state
+var reviewTransitions = map[string][]string{
+	reviewSubmitted:        {reviewInReview, reviewApproved, reviewChangesRequested},
+	reviewInReview:         {reviewApproved, reviewChangesRequested},
+	reviewChangesRequested: {reviewInReview, reviewApproved},
+	reviewApproved:         {reviewInReview, reviewChangesRequested},
+}
+
+// errReviewConflict is returned when a decision doesn't apply to the document as it stands.
+type errReviewConflict string
+
+func (e errReviewConflict) Error() string { return string(e) }
+
+// decideReview records a reviewer's decision on a document and moves it to status.
+func decideReview(documentID int64, status, reviewer, comment string) (reviewDecision, error) {
+
+	decision := reviewDecision{DocumentID: documentID, Status: status, Reviewer: reviewer, Comment: comment, Decided: time.Now()}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return decision, err
+	}
+	defer tx.Rollback()
+
+	var current string
+	var latest bool
+	sqlStatement := `
+		select rd.status, rd.ticket,
+			rd.version = (select max(version) from reviewdocument v where v.ticket = rd.ticket and v.docname = rd.docname)
+		from reviewdocument rd
+		where rd.id = $1
+		for update`
+	err = tx.QueryRow(sqlStatement, documentID).Scan(&current, &decision.JiraKey, &latest)
+	if err != nil {
+		return decision, err
+	}
+	if !latest {
+		return decision, errReviewConflict("a newer version of this document has been submitted")
+	}
+	if !containsString(reviewTransitions[current], status) {
+		return decision, errReviewConflict("can't move a review from " + current + " to " + status)
+	}
+
+	// decisions belong to the ticket's change row
+	var changeCount int
+	if err = tx.QueryRow(`select count(*) from "change" where jirakey = $1`, decision.JiraKey).Scan(&changeCount); err != nil {
+		return decision, err
+	}
+	if changeCount == 0 {
+		return decision, errReviewConflict("no change row for ticket " + decision.JiraKey)
+	}
+
+	sqlStatement = `
+		INSERT INTO public.reviewdecision
+		(documentid, jirakey, status, reviewer, comment, decided)
+		VALUES($1, $2, $3, $4, $5, $6)
+		RETURNING id`
+	err = tx.QueryRow(sqlStatement, documentID, decision.JiraKey, status, reviewer, comment, decision.Decided).Scan(&decision.ID)
+	if err != nil {
+		return decision, err
+	}
+
+	if _, err = tx.Exec(`update reviewdocument set status = $2 where id = $1`, documentID, status); err != nil {
+		return decision, err
+	}
+
+	return decision, tx.Commit()
+}
+
+// outstandingReviews returns the latest version of every required document for the
+// ticket linked to theFolder that has not been approved.
+func outstandingReviews(theFolder string) ([]reviewDocument, error) {
+	return queryReviewDocuments(`
+		where required
+		and status <> $2
+		and ticket in (select jirakey from damfolder where folder = $1)
+		and version = (select max(version) from reviewdocument latest
+			where latest.ticket = reviewdocument.ticket and latest.docname = reviewdocument.docname)`,
+		theFolder, reviewApproved)
+}
+
+// reviewDecisionHandler takes theDocumentID, theStatus, theReviewer and theComment.
+func reviewDecisionHandler(w http.ResponseWriter, r *http.Request) {
+
+	documentID, err := strconv.ParseInt(r.FormValue("theDocumentID"), 10, 64)
+	if err != nil {
+		http.Error(w, "reviewDecisionHandler() bad theDocumentID", http.StatusBadRequest)
+		return
+	}
+	theStatus := r.FormValue("theStatus")
+	if _, ok := reviewTransitions[theStatus]; !ok || theStatus == reviewSubmitted {
+		http.Error(w, "reviewDecisionHandler() theStatus must be in-review, approved or changes-requested", http.StatusBadRequest)
+		return
+	}
+	theReviewer := r.FormValue("theReviewer")
+	if theReviewer == "" {
+		http.Error(w, "reviewDecisionHandler() missing theReviewer", http.StatusBadRequest)
+		return
+	}
+
+	decision, err := decideReview(documentID, theStatus, theReviewer, r.FormValue("theComment"))
+	switch err := err.(type) {
+	case nil:
+	case errReviewConflict:
+		http.Error(w, "reviewDecisionHandler() "+err.Error(), http.StatusConflict)
+		return
+	default:
+		if err == sql.ErrNoRows {
+			http.Error(w, "unknown document", http.StatusNotFound)
+			return
+		}
+		if err, ok := err.(*pq.Error); ok {
+			printMessage("[DCC] pq ERROR:", err.Code.Name())
+		}
+		logMessage("reviewDecisionHandler() couldn't record decision : "+err.Error(), decision.JiraKey, "ERROR")
+		http.Error(w, "reviewDecisionHandler() couldn't record decision", http.StatusInternalServerError)
+		return
+	}
+
+	logMessage("reviewDecisionHandler() document "+strconv.FormatInt(documentID, 10)+" is now "+theStatus+" ("+theReviewer+")", decision.JiraKey, "INFO")
+	gEvents.publish(eventReviewDecision, folderOfTicket(decision.JiraKey), decision)
+	writeJSON(w, decision)
+}
+
+// reviewDecisionsHandler lists the decisions made on a document, oldest first.
+func reviewDecisionsHandler(w http.ResponseWriter, r *http.Request) {
+
+	params := strings.Split(r.RequestURI, ",")
+	if len(params) < 2 {
+		http.Error(w, "missing document id", http.StatusBadRequest)
+		return
+	}
+	documentID, err := strconv.ParseInt(params[1], 10, 64)
+	if err != nil {
+		http.Error(w, "bad document id", http.StatusBadRequest)
+		return
+	}
+
+	decisions := []reviewDecision{}
+
+	rows, err := db.Query(`
+		select id, documentid, jirakey, status, reviewer, comment, decided
+		from reviewdecision where documentid = $1 order by decided, id`, documentID)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			printMessage("[DCC] pq ERROR:", err.Code.Name())
+			logMessage("reviewDecisionsHandler() couldn't SELECT from reviewdecision :"+err.Code.Name(), "", "ERROR")
+		}
+		http.Error(w, "reviewDecisionsHandler() couldn't read reviewdecision", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d reviewDecision
+		if err := rows.Scan(&d.ID, &d.DocumentID, &d.JiraKey, &d.Status, &d.Reviewer, &d.Comment, &d.Decided); err != nil {
+			http.Error(w, "reviewDecisionsHandler() couldn't read reviewdecision", http.StatusInternalServerError)
+			return
+		}
+		decisions = append(decisions, d)
+	}
+
+	writeJSON(w, decisions)
+}
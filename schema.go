@@ -0,0 +1,73 @@
+package main
+
+// Schema
+// Tables owned by this service. They are created on startup if missing; the older
+// tables (damasset, damfolder, change, mirrorstate, log) are managed by the DAM, apart
+// from the damasset columns the folder watcher keeps.
+
+import (
+	"github.com/lib/pq"
+)
+
+var schemaStatements = []string{
+	`CREATE TABLE IF NOT EXISTS public.reviewdocument (
+		id        serial PRIMARY KEY,
+		ticket    text NOT NULL,
+		docname   text NOT NULL,
+		version   integer NOT NULL,
+		filepath  text NOT NULL,
+		submitter text NOT NULL DEFAULT '',
+		submitted timestamp NOT NULL,
+		size      bigint NOT NULL,
+		sha256    text NOT NULL,
+		status    text NOT NULL DEFAULT 'submitted',
+		UNIQUE (ticket, docname, version)
+	)`,
+	`ALTER TABLE public.reviewdocument ADD COLUMN IF NOT EXISTS required boolean NOT NULL DEFAULT true`,
+	`CREATE TABLE IF NOT EXISTS public.reviewdecision (
+		id         serial PRIMARY KEY,
+		documentid integer NOT NULL REFERENCES public.reviewdocument (id),
+		jirakey    text NOT NULL,
+		status     text NOT NULL,
+		reviewer   text NOT NULL,
+		comment    text NOT NULL DEFAULT '',
+		decided    timestamp NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS public.assetactivity (
+		id             serial PRIMARY KEY,
+		folder         text NOT NULL,
+		filepath       text NOT NULL,
+		resourcemainid text NOT NULL DEFAULT '',
+		action         text NOT NULL,
+		md5            text NOT NULL DEFAULT '',
+		size           bigint NOT NULL DEFAULT 0,
+		tracked        boolean NOT NULL,
+		happened       timestamp NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS assetactivity_folder ON public.assetactivity (folder, happened)`,
+	`ALTER TABLE public.damasset ADD COLUMN IF NOT EXISTS currentmd5 text`,
+	`ALTER TABLE public.damasset ADD COLUMN IF NOT EXISTS deleted timestamp`,
+	`CREATE TABLE IF NOT EXISTS public.cachingpolicy (
+		id              serial PRIMARY KEY,
+		folder          text NOT NULL DEFAULT '',
+		client          text NOT NULL DEFAULT '',
+		enabled         boolean,
+		maxarchivebytes bigint,
+		include         text[],
+		updated         timestamp NOT NULL,
+		UNIQUE (folder, client)
+	)`,
+}
+
+// initSchema creates any of this service's tables that don't exist yet.
+func initSchema() {
+	for _, statement := range schemaStatements {
+		if _, err := db.Exec(statement); err != nil {
+			if err, ok := err.(*pq.Error); ok {
+				printMessage("[DCC] pq ERROR:", err.Code.Name())
+			}
+			printMessage("[DCC] ERROR initializing schema: " + err.Error())
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+// Selective archives
+// A zip of just some of a ticket folder's assets: those named by resourcemainid or
+// folder-relative path, or every asset flagged importanttouser. The selection, and
+// anything asked for that couldn't be found, is recorded in the zip's manifest.json.
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// an asset picked for a selective archive
+type selectedAsset struct {
+	ResourceMainID string `json:"resourcemainid"` // "" for a file with no template id
+	Path           string `json:"path"`           // canonical, relative to the folder
+}
+
+// what a selective archive was asked for and what it got
+type archiveSelection struct {
+	Requested []string        `json:"requested"` // resourcemainids and paths as given
+	Important bool            `json:"important"` // every important asset was asked for
+	Assets    []selectedAsset `json:"assets"`
+	Missing   []string        `json:"missing"` // requested, but not in the folder or not allowed by the rules
+}
+
+// selectAsset finds one requested asset: a resourcemainid with a damasset row, then
+// one the index knows in the folder, then a path inside the folder. ok is false when
+// it is none of these; err is only set when damasset couldn't be read.
+func selectAsset(theFolder, item string) (asset selectedAsset, ok bool, err error) {
+
+	var canonical string
+	err = db.QueryRow(`
+		select fullfilepath from damasset
+		where folder = $1 and resourcemainid = $2`, theFolder, item).Scan(&canonical)
+	switch {
+	case err == nil:
+		if canonical, err = storedAssetPath(theFolder, canonical); err != nil {
+			return asset, false, nil
+		}
+		return selectedAsset{ResourceMainID: item, Path: canonical}, true, nil
+	case err != sql.ErrNoRows:
+		if err, ok := err.(*pq.Error); ok {
+			printMessage("[DCC] pq ERROR:", err.Code.Name())
+			logMessage("selectAsset() couldn't SELECT from damasset :"+err.Code.Name(), theFolder, "ERROR")
+		}
+		return asset, false, err
+	}
+
+	for _, entry := range gIndex.lookup(item) {
+		if entry.Source == theFolder {
+			if canonical, err := canonicalAssetPath(theFolder, entry.Path); err == nil {
+				return selectedAsset{ResourceMainID: item, Path: canonical}, true, nil
+			}
+		}
+	}
+
+	canonical, err = canonicalAssetPath(theFolder, item)
+	if err != nil {
+		return asset, false, nil
+	}
+	asset.Path = canonical
+	if path, err := serverAssetPath(theFolder, canonical); err == nil && isTemplateFile(path) {
+		if _, err := os.Stat(path); err == nil {
+			asset.ResourceMainID = getTemplateID(path)
+		}
+	}
+	return asset, true, nil
+}
+
+// importantSelection lists the assets of a folder flagged importanttouser.
+func importantSelection(theFolder string) ([]selectedAsset, error) {
+
+	var assets []selectedAsset
+
+	rows, err := db.Query(`
+		select resourcemainid, fullfilepath from damasset
+		where folder = $1 and importanttouser = 1
+		order by fullfilepath`, theFolder)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			printMessage("[DCC] pq ERROR:", err.Code.Name())
+			logMessage("importantSelection() couldn't SELECT from damasset :"+err.Code.Name(), theFolder, "ERROR")
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var asset selectedAsset
+		if err := rows.Scan(&asset.ResourceMainID, &asset.Path); err != nil {
+			return nil, err
+		}
+		if asset.Path, err = storedAssetPath(theFolder, asset.Path); err != nil {
+			logMessage("importantSelection() skipped "+asset.ResourceMainID+" : "+err.Error(), theFolder, "ERROR")
+			continue
+		}
+		assets = append(assets, asset)
+	}
+	return assets, rows.Err()
+}
+
+// selectAssets works out the files of a selective archive. Files the options don't
+// select (excluded, outside the include rules or older than since), or that aren't on
+// disk, are reported missing.
+func selectAssets(theFolder string, items []string, important bool, options archiveOptions) (archiveSelection, []string, error) {
+
+	selection := archiveSelection{Requested: items, Important: important, Assets: []selectedAsset{}, Missing: []string{}}
+	if selection.Requested == nil {
+		selection.Requested = []string{}
+	}
+
+	var candidates []selectedAsset
+	if important {
+		assets, err := importantSelection(theFolder)
+		if err != nil {
+			return selection, nil, err
+		}
+		candidates = append(candidates, assets...)
+	}
+	for _, item := range items {
+		asset, ok, err := selectAsset(theFolder, item)
+		if err != nil {
+			return selection, nil, err
+		}
+		if !ok {
+			selection.Missing = append(selection.Missing, item)
+			continue
+		}
+		candidates = append(candidates, asset)
+	}
+
+	var files []string
+	seen := map[string]bool{}
+	for _, asset := range candidates {
+		if seen[asset.Path] {
+			continue
+		}
+		seen[asset.Path] = true
+
+		path, err := serverAssetPath(theFolder, asset.Path)
+		if err != nil {
+			return selection, nil, err
+		}
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() || !options.selects(asset.Path, info) {
+			selection.Missing = append(selection.Missing, missingName(asset))
+			continue
+		}
+		selection.Assets = append(selection.Assets, asset)
+		files = append(files, path)
+	}
+	sort.Strings(selection.Missing)
+
+	return selection, files, nil
+}
+
+func missingName(asset selectedAsset) string {
+	if asset.ResourceMainID != "" {
+		return asset.ResourceMainID + " (" + asset.Path + ")"
+	}
+	return asset.Path
+}
+
+// createSelectiveArchive zips the selected files of a folder into its downloads.
+func createSelectiveArchive(theFolder string, items []string, important bool, options archiveOptions) (string, archiveSelection, error) {
+
+	selection, files, err := selectAssets(theFolder, items, important, options)
+	if err != nil {
+		return "", selection, err
+	}
+
+	if options.MaxBytes > 0 {
+		var total int64
+		for _, file := range files {
+			if info, err := os.Stat(file); err == nil {
+				total += info.Size()
+			}
+		}
+		if total > options.MaxBytes {
+			return "", selection, errArchiveTooLarge(total)
+		}
+	}
+
+	manifest, err := newArchiveManifest(theFolder)
+	if err != nil {
+		return "", selection, err
+	}
+	manifest.Selection = &selection
+	output, err := writeArchive(theFolder, "selection", files, manifest)
+	if err != nil {
+		return "", selection, err
+	}
+	return output, selection, nil
+}
+
+// selectiveArchiveHandler serves POST /selectiveArchive: theFolder, theClient, theAssets
+// (repeated, resourcemainids or folder-relative paths) and theImportant to add every
+// important asset. The client's caching policy applies as for createArchive.
+func selectiveArchiveHandler(w http.ResponseWriter, r *http.Request) {
+
+	theFolder := r.FormValue("theFolder")
+	theClient := r.FormValue("theClient")
+	if theFolder == "" {
+		http.Error(w, "missing folder", http.StatusBadRequest)
+		return
+	}
+	if _, err := ticketDir(theFolder); err != nil {
+		http.Error(w, "selectiveArchiveHandler() no such folder", http.StatusNotFound)
+		return
+	}
+
+	var items []string
+	for _, item := range r.Form["theAssets"] {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	important := false
+	if v := r.FormValue("theImportant"); v != "" {
+		b, err := parseConfigBool(v)
+		if err != nil {
+			http.Error(w, "selectiveArchiveHandler() bad theImportant", http.StatusBadRequest)
+			return
+		}
+		important = bool(b)
+	}
+	if len(items) == 0 && !important {
+		http.Error(w, "selectiveArchiveHandler() nothing selected", http.StatusBadRequest)
+		return
+	}
+
+	policy, err := resolvePolicy(theFolder, theClient)
+	if err != nil {
+		http.Error(w, "selectiveArchiveHandler() couldn't read caching policy", http.StatusInternalServerError)
+		return
+	}
+	if !policy.Enabled {
+		http.Error(w, "caching is disabled for "+policyScope(theFolder, theClient), http.StatusForbidden)
+		return
+	}
+
+	options := newArchiveOptions()
+	options.MaxBytes = policy.MaxArchiveBytes
+	if len(policy.Include) > 0 {
+		options.Include = append(options.Include, parseFileRules(policy.Include))
+	}
+
+	output, selection, err := createSelectiveArchive(theFolder, items, important, options)
+	switch err.(type) {
+	case nil:
+		logMessage(fmt.Sprintf("selectiveArchiveHandler() %d assets archived, %d missing", len(selection.Assets), len(selection.Missing)), theFolder, "INFO")
+		w.Header().Set("ETag", archiveETag(output))
+		sendFile(w, r, output)
+	case errArchiveTooLarge:
+		http.Error(w, "selectiveArchiveHandler() "+err.Error(), http.StatusRequestEntityTooLarge)
+	default:
+		logMessage("selectiveArchiveHandler() "+err.Error(), theFolder, "ERROR")
+		http.Error(w, "selectiveArchiveHandler() couldn't create archive", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+// Transform support bundle
+// The zip served at /transform_support is rebuilt from SupportSourceDir whenever
+// the source files change, and is versioned by the sha256 of its contents so
+// clients only download it when it actually changed.
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const defaultSupportBundlePath = "/opt/ckm-mirror/transform-support.zip"
+
+var supportMutex sync.Mutex // serializes rebuilds of the bundle
+var supportVersion string   // sha256 of the bundle last served
+var supportStamp string     // size/mtime of the bundle supportVersion was computed from
+
+func supportBundlePath() string {
+	if sessionConfig().SupportBundlePath != "" {
+		return sessionConfig().SupportBundlePath
+	}
+	return defaultSupportBundlePath
+}
+
+// supportFingerprint summarizes the names, sizes and mod times of every file under dir.
+func supportFingerprint(dir string) (string, []string, error) {
+	var files []string
+	hash := sha256.New()
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	sort.Strings(files)
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", nil, err
+		}
+		fmt.Fprintf(hash, "%s|%d|%d\n", file, info.Size(), info.ModTime().UnixNano())
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), files, nil
+}
+
+// refreshSupportBundle rebuilds the bundle when SupportSourceDir has changed since the
+// last build and returns the current bundle version.
+func refreshSupportBundle() (string, error) {
+	supportMutex.Lock()
+	defer supportMutex.Unlock()
+
+	bundle := supportBundlePath()
+
+	if sessionConfig().SupportSourceDir != "" {
+		fingerprint, files, err := supportFingerprint(sessionConfig().SupportSourceDir)
+		if err != nil {
+			return "", err
+		}
+
+		// the fingerprint of the sources last bundled is kept alongside the bundle
+		stampFile := bundle + ".fingerprint"
+		previous, _ := os.ReadFile(stampFile)
+		_, statErr := os.Stat(bundle)
+
+		if string(previous) != fingerprint || statErr != nil {
+			printMessage("[DCC] rebuilding transform support bundle from " + sessionConfig().SupportSourceDir)
+			if err := buildSupportBundle(bundle, sessionConfig().SupportSourceDir, files); err != nil {
+				return "", err
+			}
+			if err := os.WriteFile(stampFile, []byte(fingerprint), 0664); err != nil {
+				return "", err
+			}
+			logMessage("refreshSupportBundle() rebuilt "+bundle, "", "INFO")
+		}
+	}
+
+	info, err := os.Stat(bundle)
+	if err != nil {
+		return "", err
+	}
+
+	stamp := fmt.Sprintf("%d|%d", info.Size(), info.ModTime().UnixNano())
+	if stamp == supportStamp && supportVersion != "" {
+		return supportVersion, nil
+	}
+
+	file, err := os.Open(bundle)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	supportVersion = hex.EncodeToString(hash.Sum(nil))
+	supportStamp = stamp
+	return supportVersion, nil
+}
+
+// buildSupportBundle zips files into a temporary file next to bundle, then swaps it in
+// so a download in progress never sees a half written zip.
+func buildSupportBundle(bundle string, sourcedir string, files []string) error {
+
+	tmpfile := bundle + ".tmp"
+	newZipFile, err := os.Create(tmpfile)
+	if err != nil {
+		return err
+	}
+
+	zipWriter := zip.NewWriter(newZipFile)
+	for _, file := range files {
+		if _, err = addFileToZip(zipWriter, sourcedir, file); err != nil {
+			break
+		}
+	}
+
+	if closeErr := zipWriter.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := newZipFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+
+	return os.Rename(tmpfile, bundle)
+}
+
+// querySupportVersion lets a client check whether its copy of the bundle is stale
+// without downloading it.
+func querySupportVersion(w http.ResponseWriter) {
+
+	version, err := refreshSupportBundle()
+	if err != nil {
+		logMessage("querySupportVersion() couldn't refresh support bundle : "+err.Error(), "", "ERROR")
+		http.Error(w, "transform support bundle unavailable", http.StatusNotFound)
+		return
+	}
+
+	w.Write([]byte(version))
+}
+
+// supportDir is where the transform support files can be read: SupportSourceDir when
+// set, otherwise the bundle unpacked into a directory named by its version.
+func supportDir() (string, error) {
+
+	if sessionConfig().SupportSourceDir != "" {
+		return sessionConfig().SupportSourceDir, nil
+	}
+
+	version, err := refreshSupportBundle()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(os.TempDir(), "DAMClientCache-support-"+version[:16])
+	if _, err := os.Stat(dir); err == nil {
+		return dir, nil
+	}
+
+	supportMutex.Lock()
+	defer supportMutex.Unlock()
+
+	tmpdir, err := os.MkdirTemp(os.TempDir(), "DAMClientCache-support-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := Unzip(supportBundlePath(), tmpdir); err != nil {
+		os.RemoveAll(tmpdir)
+		return "", err
+	}
+	if err := os.Rename(tmpdir, dir); err != nil {
+		os.RemoveAll(tmpdir)
+		if _, statErr := os.Stat(dir); statErr != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+// Template XML parsing
+// Reads template files (.oet as saved by the Template Designer, or an operational
+// .opt) with a streaming decoder: either just the identifying header, or the header
+// plus every archetype and template the definition references.
+
+import (
+	"encoding/xml"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// header fields of a template file
+type templateHeader struct {
+	TemplateID string `json:"templateid"`
+	Concept    string `json:"concept"`
+}
+
+// walkTemplate streams the elements of the template in path to visit, with the
+// lower-cased element names from the root down. Start and end elements are passed
+// after the stack has been pushed or popped. visit returns false to stop early.
+func walkTemplate(path string, visit func(stack []string, token xml.Token) bool) error {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := xml.NewDecoder(file)
+	decoder.Strict = false
+
+	var stack []string // element names from the root down to the current element
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			stack = append(stack, strings.ToLower(t.Name.Local))
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if strings.TrimSpace(string(t)) == "" {
+				continue
+			}
+		}
+		if !visit(stack, token) {
+			return nil
+		}
+	}
+}
+
+// collect takes the header fields from the text of the element at path. Both the .oet
+// (template/id, template/name) and .opt (template/template_id/value, template/concept)
+// forms are understood.
+func (header *templateHeader) collect(path, text string) {
+	switch path {
+	case "template/id", "template/template_id/value":
+		if header.TemplateID == "" {
+			header.TemplateID = text
+		}
+	case "template/name", "template/concept":
+		if header.Concept == "" {
+			header.Concept = text
+		}
+	}
+}
+
+// readTemplateHeader returns the id and concept name of the template in path.
+func readTemplateHeader(path string) (templateHeader, error) {
+
+	var header templateHeader
+
+	err := walkTemplate(path, func(stack []string, token xml.Token) bool {
+		switch t := token.(type) {
+		case xml.EndElement:
+			// everything we need sits ahead of the template definition
+			return !(len(stack) == 1 && header.TemplateID != "" && header.Concept != "")
+		case xml.CharData:
+			header.collect(strings.Join(stack, "/"), strings.TrimSpace(string(t)))
+		}
+		return true
+	})
+
+	return header, err
+}
+
+// a template file with everything it references
+type templateDetail struct {
+	templateHeader
+	Archetypes []string `json:"archetypes"` // archetype ids used anywhere in the definition
+	Templates  []string `json:"templates"`  // ids of embedded templates
+}
+
+// readTemplate parses the whole template in path, collecting the archetypes and
+// embedded templates it references. Both the .oet form (archetype_id and template_id
+// attributes) and the .opt form (<archetype_id><value> elements) are understood.
+func readTemplate(path string) (templateDetail, error) {
+
+	var detail templateDetail
+
+	archetypes := map[string]bool{}
+	templates := map[string]bool{}
+
+	err := walkTemplate(path, func(stack []string, token xml.Token) bool {
+		switch t := token.(type) {
+		case xml.StartElement:
+			for _, attr := range t.Attr {
+				switch strings.ToLower(attr.Name.Local) {
+				case "archetype_id":
+					archetypes[strings.TrimSpace(attr.Value)] = true
+				case "template_id":
+					templates[strings.TrimSpace(attr.Value)] = true
+				}
+			}
+
+		case xml.CharData:
+			text := strings.TrimSpace(string(t))
+			path := strings.Join(stack, "/")
+			detail.collect(path, text)
+			if strings.HasSuffix(path, "/archetype_id/value") {
+				archetypes[text] = true
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return detail, err
+	}
+
+	delete(archetypes, "")
+	delete(templates, "")
+	delete(templates, detail.TemplateID)
+	detail.Archetypes = sortedKeys(archetypes)
+	detail.Templates = sortedKeys(templates)
+
+	return detail, nil
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadTemplate(t *testing.T) {
+
+	dir := t.TempDir()
+	oet := filepath.Join(dir, "vitals.oet")
+	opt := filepath.Join(dir, "vitals.opt")
+	if err := os.WriteFile(oet, []byte(diffOET), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(opt, []byte(diffOPT), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path        string
+		id, concept string
+		archetypes  []string
+	}{
+		{oet, "2fd0b9f4-0000-0000-0000-000000000000", "Vital signs", []string{"openEHR-EHR-COMPOSITION.encounter.v1", "openEHR-EHR-OBSERVATION.blood_pressure.v1"}},
+		{opt, "Vital signs", "", []string{"openEHR-EHR-OBSERVATION.blood_pressure.v1"}},
+	}
+
+	for _, test := range tests {
+		header, err := readTemplateHeader(test.path)
+		if err != nil || header.TemplateID != test.id || header.Concept != test.concept {
+			t.Errorf("readTemplateHeader(%s) = %+v, %v", filepath.Base(test.path), header, err)
+		}
+		detail, err := readTemplate(test.path)
+		if err != nil || detail.templateHeader != header {
+			t.Errorf("readTemplate(%s) header = %+v, %v, want %+v", filepath.Base(test.path), detail.templateHeader, err, header)
+		}
+		if strings.Join(detail.Archetypes, ",") != strings.Join(test.archetypes, ",") {
+			t.Errorf("readTemplate(%s) archetypes = %q, want %q", filepath.Base(test.path), detail.Archetypes, test.archetypes)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+// WIP trash
+// Removing a WIP asset moves its file into the ticket's trash area and keeps a copy
+// of its damasset row next to it, so the removal can be undone. The trash lives in
+// the ticket's downloads folder, which archives and the template index skip.
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var errOutsideTicket = errors.New("path is outside the ticket folder")
+
+const trashRetention = 30 * 24 * time.Hour // how long a removed asset can be restored
+
+// a damasset row as saved in the trash
+type trashedAsset struct {
+	TrashID        string     `json:"trashid"`
+	Fullfilepath   string     `json:"fullfilepath"`
+	Filename       string     `json:"filename"`
+	ResourceMainID string     `json:"resourcemainid"`
+	InitialMD5     *string    `json:"initialmd5"` // nil when damasset held NULL
+	InitialVersion int64      `json:"initialversion"`
+	Modified       bool       `json:"modified"`
+	IsLatest       bool       `json:"islatest"`
+	Created        *time.Time `json:"created"`
+	Updated        *time.Time `json:"updated"`
+	Important      int64      `json:"importanttouser"`
+	Folder         string     `json:"folder"`
+	HadFile        bool       `json:"hadfile"` // false if the file was already gone when removed
+}
+
+// ticketDir returns the server path of a ticket folder, refusing names that would
+// escape ChangesetPath.
+func ticketDir(theFolder string) (string, error) {
+	if theFolder == "" || theFolder == "." || theFolder == ".." || strings.ContainsAny(theFolder, `/\`) {
+		return "", fmt.Errorf("bad ticket folder %q", theFolder)
+	}
+	return filepath.Join(sessionConfig().ChangesetPath, theFolder), nil
+}
+
+// pathInTicket converts a stored fullfilepath to a server path inside the ticket's
+// own folder.
+func pathInTicket(theFolder, fullfilepath string) (string, error) {
+
+	canonical, err := storedAssetPath(theFolder, fullfilepath)
+	if err != nil {
+		return "", errOutsideTicket
+	}
+	return serverAssetPath(theFolder, canonical)
+}
+
+func trashDir(theFolder string) (string, error) {
+	dir, err := ticketDir(theFolder)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "downloads", "trash"), nil
+}
+
+// trashAsset moves the asset's file into the trash, records its damasset row there and
+// deletes the row.
+func trashAsset(theFolder, theTemplateID string) (trashedAsset, error) {
+
+	var asset trashedAsset
+	if strings.ContainsAny(theTemplateID, `/\`) || strings.HasPrefix(theTemplateID, ".") {
+		return asset, fmt.Errorf("bad template id %q", theTemplateID)
+	}
+
+	var initialmd5 sql.NullString
+	var initialversion, important sql.NullInt64
+	var modified, islatest sql.NullBool
+	var created, updated pq.NullTime
+
+	sqlStatement := `
+		select fullfilepath, filename, resourcemainid, initialmd5, initialversion, modified, islatest, created, updated, importanttouser, folder
+		from damasset WHERE folder = $1 AND resourcemainid = $2`
+
+	err := db.QueryRow(sqlStatement, theFolder, theTemplateID).Scan(
+		&asset.Fullfilepath, &asset.Filename, &asset.ResourceMainID, &initialmd5, &initialversion,
+		&modified, &islatest, &created, &updated, &important, &asset.Folder)
+	if err != nil {
+		return asset, err
+	}
+	if initialmd5.Valid {
+		asset.InitialMD5 = &initialmd5.String
+	}
+	asset.InitialVersion = initialversion.Int64
+	asset.Modified = modified.Bool
+	asset.IsLatest = islatest.Bool
+	asset.Important = important.Int64
+	if created.Valid {
+		asset.Created = &created.Time
+	}
+	if updated.Valid {
+		asset.Updated = &updated.Time
+	}
+
+	path, err := pathInTicket(theFolder, asset.Fullfilepath)
+	if err != nil {
+		return asset, err
+	}
+
+	trash, err := trashDir(theFolder)
+	if err != nil {
+		return asset, err
+	}
+	if err := purgeTrash(theFolder, time.Now().Add(-trashRetention)); err != nil {
+		logMessage("trashAsset() couldn't purge old trash : "+err.Error(), theFolder, "ERROR")
+	}
+	asset.TrashID = fmt.Sprintf("%d-%s", nowAsUnixMilli(), theTemplateID)
+	entryDir := filepath.Join(trash, asset.TrashID)
+	if err := os.MkdirAll(entryDir, 0775); err != nil {
+		return asset, err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if err := os.Rename(path, filepath.Join(entryDir, filepath.Base(path))); err != nil {
+			return asset, err
+		}
+		asset.HadFile = true
+	}
+
+	record, err := json.MarshalIndent(asset, "", "  ")
+	if err != nil {
+		return asset, err
+	}
+	if err := os.WriteFile(filepath.Join(entryDir, "damasset.json"), record, 0664); err != nil {
+		return asset, err
+	}
+
+	_, err = db.Exec(`DELETE FROM public.damasset WHERE folder = $1 AND resourcemainid = $2`, theFolder, theTemplateID)
+	if err != nil {
+		// the row is still there, so put the file back too
+		if asset.HadFile {
+			os.Rename(filepath.Join(entryDir, filepath.Base(path)), path)
+		}
+		os.RemoveAll(entryDir)
+	}
+	return asset, err
+}
+
+// purgeTrash deletes the trash entries of theFolder removed before cutoff.
+func purgeTrash(theFolder string, cutoff time.Time) error {
+
+	trash, err := trashDir(theFolder)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(trash)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		// ids start with the removal time in milliseconds
+		removed, err := strconv.ParseInt(strings.SplitN(entry.Name(), "-", 2)[0], 10, 64)
+		if err != nil || !entry.IsDir() || removed >= cutoff.UnixNano()/1e6 {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(trash, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// latestTrashID finds the most recent trash entry for a template in theFolder.
+func latestTrashID(theFolder, theTemplateID string) (string, error) {
+
+	trash, err := trashDir(theFolder)
+	if err != nil {
+		return "", err
+	}
+	entries, err := os.ReadDir(trash)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasSuffix(entry.Name(), "-"+theTemplateID) {
+			ids = append(ids, entry.Name())
+		}
+	}
+	if len(ids) == 0 {
+		return "", os.ErrNotExist
+	}
+
+	// ids start with the removal time in milliseconds
+	sort.Slice(ids, func(i, j int) bool {
+		return len(ids[i]) < len(ids[j]) || (len(ids[i]) == len(ids[j]) && ids[i] < ids[j])
+	})
+	return ids[len(ids)-1], nil
+}
+
+// restoreAsset puts a trashed file back and re-inserts its damasset row. It refuses to
+// overwrite a file that has since been created at the same path.
+func restoreAsset(theFolder, trashID string) (trashedAsset, error) {
+
+	var asset trashedAsset
+
+	trash, err := trashDir(theFolder)
+	if err != nil {
+		return asset, err
+	}
+	if trashID == "" || strings.ContainsAny(trashID, `/\`) || strings.HasPrefix(trashID, ".") {
+		return asset, fmt.Errorf("bad trash id %q", trashID)
+	}
+	entryDir := filepath.Join(trash, trashID)
+
+	record, err := os.ReadFile(filepath.Join(entryDir, "damasset.json"))
+	if err != nil {
+		return asset, err
+	}
+	if err := json.Unmarshal(record, &asset); err != nil {
+		return asset, err
+	}
+
+	path, err := pathInTicket(theFolder, asset.Fullfilepath)
+	if err != nil {
+		return asset, err
+	}
+
+	trashed := filepath.Join(entryDir, filepath.Base(path))
+	if asset.HadFile {
+		if _, err := os.Stat(path); err == nil {
+			return asset, os.ErrExist
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+			return asset, err
+		}
+		if err := os.Rename(trashed, path); err != nil {
+			return asset, err
+		}
+	}
+
+	sqlStatement := `
+		INSERT INTO public.damasset
+		(fullfilepath, filename, resourcemainid, initialmd5, initialversion, modified, islatest, created, updated, importanttouser, folder)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11);`
+
+	_, err = db.Exec(sqlStatement, asset.Fullfilepath, asset.Filename, asset.ResourceMainID, asset.InitialMD5, asset.InitialVersion,
+		asset.Modified, asset.IsLatest, asset.Created, time.Now(), asset.Important, asset.Folder)
+	if err != nil {
+		// leave the entry as it was so the undo can be retried
+		if asset.HadFile {
+			os.Rename(path, trashed)
+		}
+		return asset, err
+	}
+
+	return asset, os.RemoveAll(entryDir)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPurgeTrashKeepsRecentEntries(t *testing.T) {
+
+	dir := t.TempDir()
+	gConfig.Store(&configuration{ChangesetPath: dir})
+	defer gConfig.Store(emptyConfig)
+
+	now := time.Now()
+	old := fmt.Sprintf("%d-t1", now.Add(-2*trashRetention).UnixNano()/1e6)
+	recent := fmt.Sprintf("%d-t2", now.Add(-time.Hour).UnixNano()/1e6)
+	trash := filepath.Join(dir, "MINE", "downloads", "trash")
+	for _, id := range []string{old, recent, "notes"} {
+		if err := os.MkdirAll(filepath.Join(trash, id), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := purgeTrash("MINE", now.Add(-trashRetention)); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]bool{old: false, recent: true, "notes": true} {
+		if _, err := os.Stat(filepath.Join(trash, id)); (err == nil) != want {
+			t.Errorf("%s kept = %t, want %t", id, err == nil, want)
+		}
+	}
+}
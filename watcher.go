@@ -0,0 +1,273 @@
+package main
+
+// Ticket folder watcher
+// Watches every ticket folder under ChangesetPath with inotify (fsnotify). When a
+// template is saved its damasset row gets the file's current md5 and is marked modified
+// if that no longer matches the version it started from; a WIP file that disappears
+// has its row marked deleted. Every change is recorded in assetactivity for the ticket.
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/lib/pq"
+)
+
+const assetSettle = 2 * time.Second // quiet time after the last write before a file is looked at
+const assetActivityLimit = 200      // default number of activity rows returned
+
+// a change to a template in a ticket folder
+type assetActivity struct {
+	ID             int64     `json:"id"`
+	Folder         string    `json:"folder"`
+	Filepath       string    `json:"filepath"` // canonical, relative to the folder
+	ResourceMainID string    `json:"resourcemainid"`
+	Action         string    `json:"action"` // "created", "modified" or "deleted"
+	MD5            string    `json:"md5"`
+	Size           int64     `json:"size"`
+	Tracked        bool      `json:"tracked"` // the file has a damasset row
+	Happened       time.Time `json:"happened"`
+}
+
+// watchTree adds dir and every directory beneath it to the watcher, leaving out the
+// ones the index skips.
+func watchTree(watcher *fsnotify.Watcher, dir string) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if path != dir && skipIndexDir(info.Name()) {
+			return filepath.SkipDir
+		}
+		if err := watcher.Add(path); err != nil {
+			logMessage("watchTree() couldn't watch "+path+" : "+err.Error(), "", "ERROR")
+		}
+		return nil
+	})
+}
+
+// runAssetWatcher watches ChangesetPath until the watcher fails.
+func runAssetWatcher() {
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logMessage("runAssetWatcher() couldn't start : "+err.Error(), "", "ERROR")
+		return
+	}
+	defer watcher.Close()
+
+	watchTree(watcher, sessionConfig().ChangesetPath)
+
+	// editors write a file in several steps, so wait for it to settle
+	type pendingFile struct {
+		last    time.Time
+		created bool
+	}
+	pending := map[string]*pendingFile{}
+	ticker := time.NewTicker(assetSettle / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if !skipIndexDir(info.Name()) {
+						watchTree(watcher, event.Name)
+					}
+					continue
+				}
+			}
+			if !isTemplateFile(event.Name) {
+				continue
+			}
+			file, ok := pending[event.Name]
+			if !ok {
+				file = &pendingFile{}
+				pending[event.Name] = file
+			}
+			file.last = time.Now()
+			file.created = file.created || event.Has(fsnotify.Create)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logMessage("runAssetWatcher() "+err.Error(), "", "ERROR")
+
+		case <-ticker.C:
+			for path, file := range pending {
+				if time.Since(file.last) >= assetSettle {
+					delete(pending, path)
+					syncAssetFile(path, file.created)
+				}
+			}
+		}
+	}
+}
+
+// trackedAsset finds the damasset row for a canonical path in a folder. Stored paths
+// are canonicalized too, so rows not yet rewritten by migratepaths still match.
+func trackedAsset(theFolder, canonical string) (resourcemainid, fullfilepath, initialmd5 string, found bool, err error) {
+
+	rows, err := db.Query(`
+		select resourcemainid, fullfilepath, coalesce(initialmd5, '') from damasset
+		where folder = $1`, theFolder)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			printMessage("[DCC] pq ERROR:", err.Code.Name())
+			logMessage("trackedAsset() couldn't SELECT from damasset :"+err.Code.Name(), theFolder, "ERROR")
+		}
+		return "", "", "", false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := rows.Scan(&resourcemainid, &fullfilepath, &initialmd5); err != nil {
+			return "", "", "", false, err
+		}
+		if stored, err := storedAssetPath(theFolder, fullfilepath); err == nil && stored == canonical {
+			return resourcemainid, fullfilepath, initialmd5, true, nil
+		}
+	}
+	return "", "", "", false, rows.Err()
+}
+
+// syncAssetFile brings the index, damasset and assetactivity up to date with a
+// template file that changed or went away.
+func syncAssetFile(path string, created bool) {
+
+	theFolder, ok := indexSource(path)
+	if !ok || theFolder == mirrorSource {
+		return
+	}
+	canonical, err := canonicalAssetPath(theFolder, path)
+	if err != nil {
+		return
+	}
+
+	activity := assetActivity{Folder: theFolder, Filepath: canonical, Happened: time.Now()}
+
+	resourcemainid, fullfilepath, initialmd5, tracked, err := trackedAsset(theFolder, canonical)
+	if err != nil {
+		return
+	}
+	activity.ResourceMainID = resourcemainid
+	activity.Tracked = tracked
+
+	info, err := os.Stat(path)
+	switch {
+	case os.IsNotExist(err):
+		gIndex.removeFile(path)
+		activity.Action = "deleted"
+		if activity.Tracked {
+			logMessage("syncAssetFile() WIP file "+canonical+" was deleted", theFolder, "INFO")
+			_, err = db.Exec(`
+				update damasset set currentmd5 = '', deleted = $4, updated = $4
+				where folder = $1 and resourcemainid = $2 and fullfilepath = $3`,
+				theFolder, resourcemainid, fullfilepath, activity.Happened)
+			if err, ok := err.(*pq.Error); ok {
+				printMessage("[DCC] pq ERROR:", err.Code.Name())
+				logMessage("syncAssetFile() couldn't UPDATE damasset :"+err.Code.Name(), theFolder, "ERROR")
+			}
+		}
+
+	case err != nil:
+		logMessage("syncAssetFile() "+err.Error(), theFolder, "ERROR")
+		return
+
+	default:
+		gIndex.updateFile(path, info)
+		activity.Action = "modified"
+		if created {
+			activity.Action = "created"
+		}
+		activity.Size = info.Size()
+		if activity.MD5, err = fileMD5(path); err != nil {
+			logMessage("syncAssetFile() couldn't hash "+canonical+" : "+err.Error(), theFolder, "ERROR")
+			return
+		}
+		if activity.ResourceMainID == "" {
+			activity.ResourceMainID = getTemplateID(path)
+		}
+
+		if activity.Tracked {
+			_, err = db.Exec(`
+				update damasset set modified = $4, currentmd5 = $5, deleted = null, updated = $6
+				where folder = $1 and resourcemainid = $2 and fullfilepath = $3`,
+				theFolder, resourcemainid, fullfilepath, initialmd5 == "" || initialmd5 != activity.MD5, activity.MD5, activity.Happened)
+			if err, ok := err.(*pq.Error); ok {
+				printMessage("[DCC] pq ERROR:", err.Code.Name())
+				logMessage("syncAssetFile() couldn't UPDATE damasset :"+err.Code.Name(), theFolder, "ERROR")
+			}
+		}
+	}
+
+	sqlStatement := `
+		INSERT INTO public.assetactivity
+		(folder, filepath, resourcemainid, action, md5, size, tracked, happened)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id`
+	err = db.QueryRow(sqlStatement, activity.Folder, activity.Filepath, activity.ResourceMainID, activity.Action,
+		activity.MD5, activity.Size, activity.Tracked, activity.Happened).Scan(&activity.ID)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			printMessage("[DCC] pq ERROR:", err.Code.Name())
+		}
+		logMessage("syncAssetFile() couldn't INSERT into assetactivity : "+err.Error(), theFolder, "ERROR")
+	}
+
+	gEvents.publish(eventAssetActivity, theFolder, activity)
+}
+
+// assetActivityHandler serves GET /assetactivity,<folder>[,<limit>], newest first.
+func assetActivityHandler(w http.ResponseWriter, r *http.Request) {
+
+	params := strings.Split(r.RequestURI, ",")
+	if len(params) < 2 || params[1] == "" {
+		http.Error(w, "missing folder", http.StatusBadRequest)
+		return
+	}
+	theFolder := params[1]
+	limit := assetActivityLimit
+	if len(params) > 2 {
+		if n, err := strconv.Atoi(params[2]); err == nil && n > 0 {
+			limit = n
+		}
+	}
+
+	activities := []assetActivity{}
+
+	rows, err := db.Query(`
+		select id, folder, filepath, resourcemainid, action, md5, size, tracked, happened
+		from assetactivity where folder = $1
+		order by happened desc, id desc limit $2`, theFolder, limit)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			printMessage("[DCC] pq ERROR:", err.Code.Name())
+			logMessage("assetActivityHandler() couldn't SELECT from assetactivity :"+err.Code.Name(), theFolder, "ERROR")
+		}
+		http.Error(w, "assetActivityHandler() couldn't read assetactivity", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a assetActivity
+		if err := rows.Scan(&a.ID, &a.Folder, &a.Filepath, &a.ResourceMainID, &a.Action, &a.MD5, &a.Size, &a.Tracked, &a.Happened); err != nil {
+			http.Error(w, "assetActivityHandler() couldn't read assetactivity", http.StatusInternalServerError)
+			return
+		}
+		activities = append(activities, a)
+	}
+
+	writeJSON(w, activities)
+}
@@ -0,0 +1,160 @@
+package main
+
+// Where-used analysis
+// Given an archetype or template id, lists every template in the mirror and in each
+// active ticket folder that references it. Answers come from the template index and
+// are cached until the index next changes.
+
+import (
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// a template that references the id being looked up
+type whereUsedHit struct {
+	TemplateID string `json:"templateid"`
+	Concept    string `json:"concept"`
+	Filepath   string `json:"filepath"` // relative to the mirror or the ticket folder
+}
+
+type whereUsedResult struct {
+	ID      string                    `json:"id"`
+	Kind    string                    `json:"kind"` // "archetype" or "template"
+	Mirror  []whereUsedHit            `json:"mirror"`
+	Tickets map[string][]whereUsedHit `json:"tickets"` // keyed by ticket folder
+}
+
+type whereUsedCache struct {
+	mu         sync.Mutex
+	generation uint64 // index generation the cached results were computed from
+	results    map[string]whereUsedResult
+}
+
+var gWhereUsed = whereUsedCache{results: map[string]whereUsedResult{}}
+
+func referenceKind(id string) string {
+	if strings.HasPrefix(strings.ToLower(id), "openehr-") {
+		return "archetype"
+	}
+	return "template"
+}
+
+// whereUsed returns every indexed template, in any folder, that references id.
+func whereUsed(id string) whereUsedResult {
+
+	generation := gIndex.currentGeneration()
+
+	gWhereUsed.mu.Lock()
+	if gWhereUsed.generation != generation {
+		gWhereUsed.results = map[string]whereUsedResult{}
+		gWhereUsed.generation = generation
+	}
+	result, ok := gWhereUsed.results[id]
+	gWhereUsed.mu.Unlock()
+	if ok {
+		return result
+	}
+
+	result = whereUsedResult{ID: id, Kind: referenceKind(id), Mirror: []whereUsedHit{}, Tickets: map[string][]whereUsedHit{}}
+
+	hits := gIndex.find(func(entry *indexedTemplate) bool {
+		return containsString(entry.Archetypes, id) || containsString(entry.Templates, id)
+	})
+	for _, entry := range hits {
+		root := sessionConfig().MirrorCkmPath
+		if entry.Source != mirrorSource {
+			root = filepath.Join(sessionConfig().ChangesetPath, entry.Source)
+		}
+		relpath, err := filepath.Rel(root, entry.Path)
+		if err != nil {
+			relpath = entry.Path
+		}
+		hit := whereUsedHit{TemplateID: entry.TemplateID, Concept: entry.Concept, Filepath: filepath.ToSlash(relpath)}
+
+		if entry.Source == mirrorSource {
+			result.Mirror = append(result.Mirror, hit)
+		} else {
+			result.Tickets[entry.Source] = append(result.Tickets[entry.Source], hit)
+		}
+	}
+
+	gWhereUsed.mu.Lock()
+	if gWhereUsed.generation == generation {
+		gWhereUsed.results[id] = result
+	}
+	gWhereUsed.mu.Unlock()
+
+	return result
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// activeFolders returns the ticket folders of every active change.
+func activeFolders() (map[string]bool, error) {
+
+	folders := map[string]bool{}
+
+	rows, err := db.Query(`select folder from change where active = true`)
+	if err != nil {
+		if err, ok := err.(*pq.Error); ok {
+			printMessage("[DCC] pq ERROR:", err.Code.Name())
+			logMessage("activeFolders() couldn't SELECT from change :"+err.Code.Name(), "", "ERROR")
+		}
+		return folders, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var folder string
+		if err := rows.Scan(&folder); err != nil {
+			return folders, err
+		}
+		folders[folder] = true
+	}
+
+	return folders, rows.Err()
+}
+
+func whereUsedHandler(w http.ResponseWriter, r *http.Request) {
+
+	params := strings.Split(r.RequestURI, ",")
+	if len(params) < 2 {
+		http.Error(w, "missing archetype or template id", http.StatusBadRequest)
+		return
+	}
+
+	id, err := url.QueryUnescape(params[1])
+	if err != nil || id == "" {
+		http.Error(w, "bad archetype or template id", http.StatusBadRequest)
+		return
+	}
+
+	active, err := activeFolders()
+	if err != nil {
+		http.Error(w, "couldn't read active tickets", http.StatusInternalServerError)
+		return
+	}
+
+	// the cached result covers every folder; only active tickets are reported
+	cached := whereUsed(id)
+	result := whereUsedResult{ID: cached.ID, Kind: cached.Kind, Mirror: cached.Mirror, Tickets: map[string][]whereUsedHit{}}
+	for folder, hits := range cached.Tickets {
+		if active[folder] {
+			result.Tickets[folder] = hits
+		}
+	}
+
+	writeJSON(w, result)
+}
@@ -0,0 +1,378 @@
+package main
+
+// Semantic template diff
+// Compares a ticket's template with the mirror's copy of the same template id as XML
+// trees rather than lines. Elements are matched on their identifying attribute
+// (path, archetype_id, ...) so reordering isn't reported, and each change is labelled
+// as a constraint, terminology or other change.
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// an element of a parsed template. Names keep their namespace prefix as written
+// ("xsi:type") so a tree can be written back out unchanged.
+type xmlNode struct {
+	Name      string
+	Attrs     map[string]string
+	AttrOrder []string // attribute names in document order
+	Text      string
+	Children  []*xmlNode
+	Prolog    string // <?xml ...?> declaration, document node only
+}
+
+func rawName(name xml.Name) string {
+	if name.Space != "" {
+		return name.Space + ":" + name.Local
+	}
+	return name.Local
+}
+
+// isNamespaceAttr is true for xmlns declarations, which aren't template content.
+func isNamespaceAttr(name string) bool {
+	return name == "xmlns" || strings.HasPrefix(name, "xmlns:")
+}
+
+// attributes that identify an element among its siblings, in order of preference
+var xmlKeyAttrs = []string{"path", "archetype_id", "template_id", "id", "code", "name"}
+
+type nodeChange struct {
+	Path     string `json:"path"`
+	Category string `json:"category"` // "constraint", "terminology" or "other"
+	Field    string `json:"field"`    // attribute name, or "text" for element content
+	Before   string `json:"before"`
+	After    string `json:"after"`
+}
+
+type nodeEdit struct {
+	Path     string `json:"path"`
+	Category string `json:"category"`
+	Element  string `json:"element"`
+	Summary  string `json:"summary"`
+}
+
+type templateDiff struct {
+	TemplateID string       `json:"templateid"`
+	Concept    string       `json:"concept"`
+	Filepath   string       `json:"filepath"` // relative to the ticket folder
+	InMirror   bool         `json:"inmirror"`
+	Added      []nodeEdit   `json:"added"`
+	Removed    []nodeEdit   `json:"removed"`
+	Changed    []nodeChange `json:"changed"`
+}
+
+func parseXMLTree(path string) (*xmlNode, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	decoder := xml.NewDecoder(file)
+	decoder.Strict = false
+
+	root := &xmlNode{Name: "#document"}
+	stack := []*xmlNode{root}
+
+	for {
+		// raw tokens keep namespace prefixes as written
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{Name: rawName(t.Name), Attrs: map[string]string{}}
+			for _, attr := range t.Attr {
+				name := rawName(attr.Name)
+				node.Attrs[name] = attr.Value
+				node.AttrOrder = append(node.AttrOrder, name)
+			}
+			parent := stack[len(stack)-1]
+			parent.Children = append(parent.Children, node)
+			stack = append(stack, node)
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			stack[len(stack)-1].Text += string(t)
+		case xml.ProcInst:
+			if t.Target == "xml" && len(stack) == 1 {
+				root.Prolog = "<?xml " + string(t.Inst) + "?>"
+			}
+		}
+	}
+
+	var trim func(*xmlNode)
+	trim = func(n *xmlNode) {
+		n.Text = strings.TrimSpace(n.Text)
+		for _, child := range n.Children {
+			trim(child)
+		}
+	}
+	trim(root)
+
+	return root, nil
+}
+
+// childKeys names each child by its element and identifying attribute, numbering
+// children that can't otherwise be told apart.
+func childKeys(n *xmlNode) ([]string, map[string]*xmlNode) {
+
+	keys := make([]string, 0, len(n.Children))
+	byKey := map[string]*xmlNode{}
+	seen := map[string]int{}
+
+	for _, child := range n.Children {
+		key := child.Name
+		for _, attr := range xmlKeyAttrs {
+			if v, ok := child.Attrs[attr]; ok && v != "" {
+				key = fmt.Sprintf("%s[@%s='%s']", child.Name, attr, v)
+				break
+			}
+		}
+		seen[key]++
+		if seen[key] > 1 {
+			key = fmt.Sprintf("%s[%d]", key, seen[key])
+		}
+		keys = append(keys, key)
+		byKey[key] = child
+	}
+
+	return keys, byKey
+}
+
+// element and attribute names, lower cased, from the openEHR template (.oet) and
+// operational template (.opt) schemas that carry terminology or constraints
+var terminologyNames = map[string]bool{
+	"term_definitions": true, "term_bindings": true, "term_binding": true, "constraint_definitions": true,
+	"constraint_bindings": true, "terminologies_available": true, "terminology_id": true, "terminology": true,
+	"defining_code": true, "code_string": true, "code_list": true, "termcode": true, "termquery": true,
+	"termsetid": true, "valueset": true,
+}
+
+var constraintNames = map[string]bool{
+	"occurrences": true, "existence": true, "cardinality": true, "lower": true, "upper": true,
+	"lower_included": true, "upper_included": true, "lower_unbounded": true, "upper_unbounded": true,
+	"is_ordered": true, "is_unique": true, "attribute_name": true, "rm_attribute_name": true,
+	"includes": true, "excludes": true, "assertions": true, "string_expression": true, "expression": true,
+	"pattern": true, "list": true, "range": true, "interval": true, "precision": true, "magnitude": true,
+	"units": true, "default_value": true, "assumed_value": true, "xsi:type": true,
+	"min": true, "max": true, "hide_on_form": true, "default": true, "limittolist": true, "constraint": true,
+}
+
+// splitNodePath splits a diff path into element keys, leaving the "/" inside a key's
+// [@path='...'] alone.
+func splitNodePath(path string) []string {
+	var keys []string
+	depth, start := 0, 0
+	for i, r := range path {
+		switch r {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case '/':
+			if depth == 0 {
+				keys = append(keys, path[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(keys, path[start:])
+}
+
+// changeCategory decides what kind of change happens at field of the element at path,
+// by whole element and attribute names.
+func changeCategory(path, field string) string {
+
+	// the field itself is the strongest signal, then the element, then its ancestors
+	candidates := []string{strings.ToLower(field)}
+	elements := splitNodePath(path)
+	for i := len(elements) - 1; i >= 0; i-- {
+		name := elements[i]
+		if j := strings.Index(name, "["); j >= 0 {
+			name = name[:j]
+		}
+		candidates = append(candidates, strings.ToLower(name))
+	}
+
+	for _, candidate := range candidates {
+		if terminologyNames[candidate] {
+			return "terminology"
+		}
+		if constraintNames[candidate] {
+			return "constraint"
+		}
+	}
+	return "other"
+}
+
+func summarizeNode(n *xmlNode) string {
+	var parts []string
+	keys := make([]string, 0, len(n.Attrs))
+	for k := range n.Attrs {
+		if !isNamespaceAttr(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		parts = append(parts, k+"="+n.Attrs[k])
+	}
+	if n.Text != "" {
+		parts = append(parts, fmt.Sprintf("%q", n.Text))
+	}
+	if len(n.Children) > 0 {
+		parts = append(parts, fmt.Sprintf("%d children", len(n.Children)))
+	}
+	return strings.Join(parts, " ")
+}
+
+// diffNodes compares two matched elements and everything beneath them.
+func diffNodes(path string, before, after *xmlNode, diff *templateDiff) {
+
+	fields := map[string]bool{}
+	for k := range before.Attrs {
+		fields[k] = true
+	}
+	for k := range after.Attrs {
+		fields[k] = true
+	}
+	for _, field := range sortedKeys(fields) {
+		if isNamespaceAttr(field) {
+			continue
+		}
+		if before.Attrs[field] != after.Attrs[field] {
+			diff.Changed = append(diff.Changed, nodeChange{path, changeCategory(path, field), field, before.Attrs[field], after.Attrs[field]})
+		}
+	}
+	if before.Text != after.Text {
+		diff.Changed = append(diff.Changed, nodeChange{path, changeCategory(path, ""), "text", before.Text, after.Text})
+	}
+
+	beforeKeys, beforeByKey := childKeys(before)
+	afterKeys, afterByKey := childKeys(after)
+
+	for _, key := range beforeKeys {
+		childPath := path + "/" + key
+		if other, ok := afterByKey[key]; ok {
+			diffNodes(childPath, beforeByKey[key], other, diff)
+		} else {
+			diff.Removed = append(diff.Removed, nodeEdit{childPath, changeCategory(childPath, ""), beforeByKey[key].Name, summarizeNode(beforeByKey[key])})
+		}
+	}
+	for _, key := range afterKeys {
+		if _, ok := beforeByKey[key]; !ok {
+			childPath := path + "/" + key
+			diff.Added = append(diff.Added, nodeEdit{childPath, changeCategory(childPath, ""), afterByKey[key].Name, summarizeNode(afterByKey[key])})
+		}
+	}
+}
+
+// diffTemplateFiles compares the mirror copy of a template with the ticket's copy.
+func diffTemplateFiles(mirrorPath, ticketPath string) (templateDiff, error) {
+
+	diff := templateDiff{InMirror: true, Added: []nodeEdit{}, Removed: []nodeEdit{}, Changed: []nodeChange{}}
+
+	before, err := parseXMLTree(mirrorPath)
+	if err != nil {
+		return diff, err
+	}
+	after, err := parseXMLTree(ticketPath)
+	if err != nil {
+		return diff, err
+	}
+
+	diffNodes("", before, after, &diff)
+	return diff, nil
+}
+
+// diffFolderTemplates diffs every template in a ticket folder (or only templateID when
+// given) against the mirror.
+func diffFolderTemplates(theFolder, templateID string) ([]templateDiff, error) {
+
+	diffs := []templateDiff{}
+
+	dir, err := ticketDir(theFolder)
+	if err != nil {
+		return diffs, err
+	}
+
+	entries := gIndex.find(func(entry *indexedTemplate) bool {
+		return entry.Source == theFolder && (templateID == "" || entry.TemplateID == templateID)
+	})
+
+	for _, entry := range entries {
+		relpath, _ := filepath.Rel(dir, entry.Path)
+
+		diff := templateDiff{Added: []nodeEdit{}, Removed: []nodeEdit{}, Changed: []nodeChange{}}
+		for _, other := range gIndex.lookup(entry.TemplateID) {
+			if other.Source == mirrorSource {
+				if diff, err = diffTemplateFiles(other.Path, entry.Path); err != nil {
+					return diffs, fmt.Errorf("%s: %v", relpath, err)
+				}
+				break
+			}
+		}
+
+		diff.TemplateID = entry.TemplateID
+		diff.Concept = entry.Concept
+		diff.Filepath = filepath.ToSlash(relpath)
+		diffs = append(diffs, diff)
+	}
+
+	return diffs, nil
+}
+
+// templateDiffHandler serves GET /templatediff,<folder>[,<templateid>]
+func templateDiffHandler(w http.ResponseWriter, r *http.Request) {
+
+	params := strings.Split(r.RequestURI, ",")
+	if len(params) < 2 || params[1] == "" {
+		http.Error(w, "missing folder", http.StatusBadRequest)
+		return
+	}
+	theFolder := params[1]
+
+	templateID := ""
+	if len(params) > 2 {
+		templateID, _ = url.QueryUnescape(params[2])
+	}
+
+	// the background refresh and the folder watcher keep the index current
+	if !gIndex.isLoaded() {
+		http.Error(w, "templateDiffHandler() "+errIndexNotLoaded.Error()+", try again shortly", http.StatusServiceUnavailable)
+		return
+	}
+
+	diffs, err := diffFolderTemplates(theFolder, templateID)
+	if err != nil {
+		logMessage("templateDiffHandler() "+err.Error(), theFolder, "ERROR")
+		http.Error(w, "templateDiffHandler() couldn't diff templates : "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if templateID != "" && len(diffs) == 0 {
+		http.Error(w, "unknown template: "+templateID, http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, struct {
+		Folder    string         `json:"folder"`
+		Templates []templateDiff `json:"templates"`
+	}{theFolder, diffs})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a cut-down operational template
+const diffOPT = `<?xml version="1.0" encoding="utf-8"?>
+<template xmlns="http://schemas.openehr.org/v1" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <template_id><value>Vital signs</value></template_id>
+  <definition>
+    <rm_type_name>COMPOSITION</rm_type_name>
+    <occurrences><lower_included>true</lower_included><upper_included>true</upper_included><lower>1</lower><upper>1</upper></occurrences>
+    <node_id/>
+    <attributes xsi:type="C_MULTIPLE_ATTRIBUTE">
+      <rm_attribute_name>content</rm_attribute_name>
+      <children xsi:type="C_ARCHETYPE_ROOT">
+        <rm_type_name>OBSERVATION</rm_type_name>
+        <occurrences><lower>0</lower><upper>1</upper></occurrences>
+        <node_id>at0000</node_id>
+        <archetype_id><value>openEHR-EHR-OBSERVATION.blood_pressure.v1</value></archetype_id>
+        <term_definitions code="at0000">
+          <items id="text">Blood pressure</items>
+        </term_definitions>
+        <term_bindings terminology="SNOMED-CT">
+          <items code="at0000"><value><terminology_id><value>SNOMED-CT</value></terminology_id><code_string>75367002</code_string></value></items>
+        </term_bindings>
+      </children>
+    </attributes>
+  </definition>
+</template>`
+
+// a cut-down design-time template
+const diffOET = `<?xml version="1.0"?>
+<template xmlns="openEHR/v1/Template" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <id>2fd0b9f4-0000-0000-0000-000000000000</id>
+  <name>Vital signs</name>
+  <definition archetype_id="openEHR-EHR-COMPOSITION.encounter.v1" concept_name="Encounter">
+    <Content archetype_id="openEHR-EHR-OBSERVATION.blood_pressure.v1" concept_name="Blood pressure" path="/content">
+      <Rule path="/data[at0001]/events[at0006]" max="1" />
+      <Rule path="/data[at0001]/events[at0006]/data[at0003]/items[at0004]/value" default="120" />
+    </Content>
+  </definition>
+</template>`
+
+func diffStrings(t *testing.T, before, after string) templateDiff {
+	t.Helper()
+	dir := t.TempDir()
+	beforePath, afterPath := filepath.Join(dir, "before.opt"), filepath.Join(dir, "after.opt")
+	if err := os.WriteFile(beforePath, []byte(before), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(afterPath, []byte(after), 0644); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := diffTemplateFiles(beforePath, afterPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return diff
+}
+
+func TestChangeCategoryOfTemplateEdits(t *testing.T) {
+
+	tests := []struct {
+		name, template, from, to string
+		want                     string
+	}{
+		{"archetype id", diffOPT, "blood_pressure.v1</value>", "blood_pressure.v2</value>", "other"},
+		{"rm type name", diffOPT, "<rm_type_name>OBSERVATION</rm_type_name>", "<rm_type_name>EVALUATION</rm_type_name>", "other"},
+		{"template id", diffOPT, "<value>Vital signs</value>", "<value>Vitals</value>", "other"},
+		{"occurrences", diffOPT, "<occurrences><lower>0</lower><upper>1</upper>", "<occurrences><lower>1</lower><upper>1</upper>", "constraint"},
+		{"attribute name", diffOPT, "<rm_attribute_name>content</rm_attribute_name>", "<rm_attribute_name>context</rm_attribute_name>", "constraint"},
+		{"xsi:type", diffOPT, `<children xsi:type="C_ARCHETYPE_ROOT">`, `<children xsi:type="C_COMPLEX_OBJECT">`, "constraint"},
+		{"term definition", diffOPT, ">Blood pressure</items>", ">Blood pressure reading</items>", "terminology"},
+		{"term binding", diffOPT, "<code_string>75367002</code_string>", "<code_string>163020007</code_string>", "terminology"},
+		{"oet rule max", diffOET, `max="1"`, `max="3"`, "constraint"},
+		{"oet rule default", diffOET, `default="120"`, `default="110"`, "constraint"},
+		{"oet concept name", diffOET, `concept_name="Blood pressure"`, `concept_name="BP"`, "other"},
+		{"oet template name", diffOET, "<name>Vital signs</name>", "<name>Vitals</name>", "other"},
+	}
+
+	for _, test := range tests {
+		if !strings.Contains(test.template, test.from) {
+			t.Fatalf("%s: fragment %q not in template", test.name, test.from)
+		}
+		diff := diffStrings(t, test.template, strings.Replace(test.template, test.from, test.to, 1))
+		if len(diff.Changed) != 1 || len(diff.Added) != 0 || len(diff.Removed) != 0 {
+			t.Errorf("%s: diff %+v, want one change", test.name, diff)
+			continue
+		}
+		if got := diff.Changed[0].Category; got != test.want {
+			t.Errorf("%s: %s %s is %q, want %q", test.name, diff.Changed[0].Path, diff.Changed[0].Field, got, test.want)
+		}
+	}
+}
+
+func TestSplitNodePath(t *testing.T) {
+	got := splitNodePath("/definition/Content[@path='/content']/Rule[@path='/data[at0001]/events[at0006]']")
+	want := []string{"", "definition", "Content[@path='/content']", "Rule[@path='/data[at0001]/events[at0006]']"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("splitNodePath = %q, want %q", got, want)
+	}
+}